@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"rex-hive-daemon/control_api"
+	"rex-hive-daemon/replica_registry"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// attach streams the live output of a replica of a running daemon and forwards the typed lines to its stdin. Detaching
+// never stops the replica. Eg: `rex-hive-daemon attach 0`. Returns the exit code.
+func attach(args []string) int {
+	flags := flag.NewFlagSet("attach", flag.ExitOnError)
+	socketPtr := flags.String("control-socket", control_api.DefaultSocketPath(), "unix socket of the daemon's control API")
+	detachPtr := flags.String("detach", "~.", "line that detaches from the replica, Ctrl-D and Ctrl-C also detach")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rex-hive-daemon attach [--control-socket=path] [--detach=line] <index>")
+		return 2
+	}
+	index, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid replica index:", flags.Arg(0))
+		return 2
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", *socketPtr)
+		},
+	}}
+	baseUrl := fmt.Sprintf("http://rex/replicas/%d", index)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl+"/output", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot reach the daemon:", err)
+		return 1
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		fmt.Fprintln(os.Stderr, "cannot attach:", strings.TrimSpace(string(b)))
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("attached to replica %d, type '%s' or press Ctrl-D to detach", index, *detachPtr))
+
+	// Ctrl-C detaches instead of reaching the replica
+	sigsChan := make(chan os.Signal, 1)
+	signal.Notify(sigsChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigsChan
+		cancel()
+	}()
+
+	// Forward typed lines to the replica's stdin
+	go func() {
+		defer cancel()
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == *detachPtr {
+				return
+			}
+			res, err := client.Post(baseUrl+"/stdin", "text/plain", strings.NewReader(line))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "cannot write to stdin:", err)
+				continue
+			}
+			if res.StatusCode != http.StatusNoContent {
+				b, _ := io.ReadAll(res.Body)
+				fmt.Fprintln(os.Stderr, "cannot write to stdin:", strings.TrimSpace(string(b)))
+			}
+			res.Body.Close()
+		}
+	}()
+
+	// Print the replica's output until detaching or the daemon goes away
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var o replica_registry.Output
+		if err := decoder.Decode(&o); err != nil {
+			break
+		}
+		end := "\n"
+		if o.Continued {
+			end = ""
+		}
+		switch o.Stream {
+		case "stdout":
+			fmt.Fprint(os.Stdout, o.Data+end)
+		case "stderr":
+			fmt.Fprint(os.Stderr, o.Data+end)
+		default:
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("[%d:%d:%d] %s %s", index, o.Pid, o.Attempt, o.Stream, o.Data))
+		}
+	}
+	fmt.Fprintln(os.Stderr, "detached from replica", index)
+	return 0
+}
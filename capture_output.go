@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/log_rotation"
+	"rex-hive-daemon/redact"
+	"rex-hive-daemon/replica_registry"
+	"syscall"
+	"unicode/utf8"
+)
+import p "rex-hive-daemon/rexprint"
+
+// runAttempt identifies a single run of a replica, from the moment it gets a PID until it exits.
+type runAttempt struct {
+	hiveChan    *chan *hive_message.HiveMessage
+	index       int
+	pid         int
+	attempt     int
+	source      p.Source
+	processSpec *hive_spec.ProcessSpec
+	// logFile, if not nil, receives all the output of the attempt.
+	logFile *log_rotation.File
+	// redactor masks sensitive values in the output before it's printed or stored anywhere.
+	redactor *redact.Redactor
+}
+
+// captureOutput prints, publishes and sends to hiveChan every line read from r, until r is exhausted. Lines longer
+// than the max line length of the process spec are split in multiple messages, all but the last one flagged as
+// continued. transform, if not nil, is applied to every line before anything else.
+func (a *runAttempt) captureOutput(r io.Reader, messageType hive_message.HiveMessageType, transform func(string) string) {
+	maxLineLength := hive_spec.DefaultMaxLineLength
+	if a.processSpec.MaxLineLength > 0 {
+		maxLineLength = a.processSpec.MaxLineLength
+	}
+	reader := bufio.NewReaderSize(r, maxLineLength)
+
+	var aggregator *multilineAggregator
+	if a.processSpec.Multiline != nil {
+		aggregator = newMultilineAggregator(a.processSpec.Multiline, func(data string) {
+			a.sendMessage(messageType, data, false)
+		})
+		defer aggregator.flush()
+	}
+
+	// Bytes of a multibyte character cut in half by a chunk, carried over to the next chunk
+	var pending []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line := append(pending, chunk...)
+		pending = nil
+
+		switch {
+		case err == nil:
+			a.sendOutput(messageType, transform, aggregator, string(dropCR(line[:len(line)-1])), false)
+		case errors.Is(err, bufio.ErrBufferFull):
+			cut := lastRuneBoundary(line)
+			pending = append([]byte{}, line[cut:]...)
+			a.sendOutput(messageType, transform, aggregator, string(line[:cut]), true)
+		default:
+			// Flush the last line even if it has no trailing new line
+			if len(line) > 0 {
+				a.sendOutput(messageType, transform, aggregator, string(dropCR(line)), false)
+			}
+			if !isEndOfOutput(err) {
+				a.sendCaptureError(messageType, err)
+			}
+			return
+		}
+	}
+}
+
+// sendOutput prints and publishes a line right away, and sends it to hiveChan either directly or through the multiline
+// aggregator, if not nil.
+func (a *runAttempt) sendOutput(messageType hive_message.HiveMessageType, transform func(string) string, aggregator *multilineAggregator, m string, continued bool) {
+	if transform != nil {
+		m = transform(m)
+	}
+	m = a.redactor.Redact(m)
+
+	if continued {
+		p.PrintStream(a.source, string(messageType), m, p.Dim("(continues)"))
+	} else {
+		p.PrintStream(a.source, string(messageType), m)
+	}
+
+	replica_registry.Publish(a.index, replica_registry.Output{Stream: string(messageType), Pid: a.pid, Attempt: a.attempt, Data: m, Continued: continued})
+	writeReplicaLog(a.logFile, string(messageType), a.pid, a.attempt, m)
+
+	if aggregator == nil {
+		a.sendMessage(messageType, m, continued)
+		return
+	}
+	if continued {
+		// Chunks of long lines are never merged, keep them in order with the lines before
+		aggregator.flush()
+		a.sendMessage(messageType, m, continued)
+		return
+	}
+	aggregator.add(m)
+}
+
+func (a *runAttempt) sendMessage(messageType hive_message.HiveMessageType, m string, continued bool) {
+	message := &hive_message.HiveMessage{
+		Index:     a.index,
+		Pid:       a.pid,
+		Attempt:   a.attempt,
+		Type:      messageType,
+		Data:      m,
+		Continued: continued,
+		ExitCode:  noExitCode,
+	}
+	// Chunks of long lines are never valid JSON by themselves, they're kept as raw data
+	if a.processSpec.LogFormat == hive_spec.LogFormatJson && !continued {
+		setJsonLog(message, m)
+	}
+	*a.hiveChan <- message
+}
+
+// sendCaptureError reports, as a stderr message, that the output of the process can no longer be captured.
+func (a *runAttempt) sendCaptureError(messageType hive_message.HiveMessageType, err error) {
+	m := fmt.Sprintf("rex-hive-daemon: cannot capture %s anymore: %s", messageType, err)
+	p.PrintStream(a.source, string(hive_message.ProcessStdErr), m)
+	writeReplicaLog(a.logFile, string(hive_message.ProcessStdErr), a.pid, a.attempt, m)
+	*a.hiveChan <- &hive_message.HiveMessage{
+		Index:    a.index,
+		Pid:      a.pid,
+		Attempt:  a.attempt,
+		Type:     hive_message.ProcessStdErr,
+		Data:     m,
+		ExitCode: noExitCode,
+	}
+}
+
+// isEndOfOutput tells if the error is the regular end of the output of a process. A pseudo-terminal master fails with
+// EIO once the slave is closed, and it's closed by the daemon if descendants of the process keep it open for too long.
+func isEndOfOutput(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EIO) || errors.Is(err, os.ErrClosed)
+}
+
+// dropCR drops a terminal \r from a line, like bufio.ScanLines does, so "\r\n" line endings leave no stray \r.
+func dropCR(line []byte) []byte {
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1]
+	}
+	return line
+}
+
+// lastRuneBoundary returns the length of the longest prefix of b that doesn't end in an incomplete UTF-8 character.
+func lastRuneBoundary(b []byte) int {
+	// A UTF-8 character is at most utf8.UTFMax bytes long, only the last few bytes need to be checked
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			return len(b)
+		}
+	}
+	return len(b)
+}
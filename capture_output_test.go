@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/hive_spec"
+	"strings"
+	"testing"
+)
+
+func TestLastRuneBoundary(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+		want int
+	}{
+		{"ascii", "abc", 3},
+		{"complete multibyte character", "abé", 4},
+		{"first byte of a 2 bytes character", "ab\xc3", 2},
+		{"first 2 bytes of a 4 bytes character", "ab\xf0\x9f", 2},
+		{"first 3 bytes of a 4 bytes character", "ab\xf0\x9f\x98", 2},
+		{"complete 4 bytes character", "ab😀", 6},
+		{"invalid continuation bytes are kept", "ab\x80\x80", 4},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastRuneBoundary([]byte(tt.b)); got != tt.want {
+				t.Errorf("lastRuneBoundary(%q) = %d, want %d", tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+type capturedMessage struct {
+	data      string
+	continued bool
+}
+
+// capture runs captureOutput on the output and returns the messages sent.
+func capture(t *testing.T, processSpec *hive_spec.ProcessSpec, output string) []capturedMessage {
+	t.Helper()
+	hiveChan := make(chan *hive_message.HiveMessage, 100)
+	a := &runAttempt{hiveChan: &hiveChan, processSpec: processSpec}
+	a.captureOutput(strings.NewReader(output), hive_message.ProcessStdOut, nil)
+	close(hiveChan)
+
+	var messages []capturedMessage
+	for m := range hiveChan {
+		messages = append(messages, capturedMessage{m.Data, m.Continued})
+	}
+	return messages
+}
+
+func TestCaptureOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []capturedMessage
+	}{
+		{"lines", "first\r\nsecond\n", []capturedMessage{{"first", false}, {"second", false}}},
+		{"last line without new line", "first\nlast", []capturedMessage{{"first", false}, {"last", false}}},
+		{"long line split in chunks", "0123456789abcdefghij\n", []capturedMessage{
+			{"0123456789abcdef", true},
+			{"ghij", false},
+		}},
+		{"chunks cut at rune boundaries", "0123456789abcdeé\n", []capturedMessage{
+			// é is 2 bytes long, the 16 bytes chunk would end with its first byte
+			{"0123456789abcde", true},
+			{"é", false},
+		}},
+		{"4 bytes characters", "a😀😀😀😀\n", []capturedMessage{
+			{"a😀😀😀", true},
+			{"😀", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The smallest buffer of a bufio.Reader is 16 bytes
+			got := capture(t, &hive_spec.ProcessSpec{MaxLineLength: 16}, tt.output)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package control_api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"rex-hive-daemon/replica_registry"
+	"rex-hive-daemon/rexprint"
+	"strconv"
+	"strings"
+)
+
+const maxStdinLineBytes = 64 * 1024
+
+// DefaultSocketPath is the unix socket the control API listens on when no other path is given.
+func DefaultSocketPath() string {
+	return fmt.Sprintf("%s/rex-hive-daemon.sock", strings.TrimRight(os.TempDir(), "/"))
+}
+
+// Run serves the control API over a unix socket at socketPath. It blocks until the listener fails.
+func Run(socketPath string) {
+	// Remove a stale socket left behind by a previous daemon, never the socket of a daemon still running
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot listen on control socket %s: another daemon is listening on it", socketPath)))
+		return
+	}
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot listen on control socket %s: the file exists and is not a socket", socketPath)))
+			return
+		}
+		_ = os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot listen on control socket %s: %s", socketPath, err)))
+		return
+	}
+	defer func() { _ = os.Remove(socketPath) }()
+	rexprint.Println(rexprint.Dim(fmt.Sprintf("control API listening on %s", socketPath)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replicas/", handleReplica)
+	if err := http.Serve(listener, mux); err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("control API stopped: %s", err)))
+	}
+}
+
+// handleReplica routes `/replicas/<index>/<action>` requests.
+func handleReplica(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/replicas/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid replica index '%s'", parts[0]), http.StatusBadRequest)
+		return
+	}
+
+	switch parts[1] {
+	case "stdin":
+		handleStdin(w, r, index)
+	case "output":
+		handleOutput(w, r, index)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleStdin writes the request body as a line to the stdin of the replica. Eg:
+// `curl --unix-socket /tmp/rex-hive-daemon.sock -X POST -d 'quit' http://rex/replicas/0/stdin`
+func handleStdin(w http.ResponseWriter, r *http.Request, index int) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStdinLineBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("line is longer than %d bytes", maxStdinLineBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = replica_registry.WriteLine(index, string(body))
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, replica_registry.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, replica_registry.ErrNoStdin):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, replica_registry.ErrMultipleLines):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, replica_registry.ErrStdinTimeout):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleOutput streams the output of the replica as JSON lines until the client disconnects. Eg:
+// `curl --unix-socket /tmp/rex-hive-daemon.sock http://rex/replicas/0/output`
+func handleOutput(w http.ResponseWriter, r *http.Request, index int) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	output, cancel, err := replica_registry.Subscribe(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case o := <-output:
+			if err := encoder.Encode(o); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
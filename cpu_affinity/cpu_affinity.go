@@ -0,0 +1,63 @@
+package cpu_affinity
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseList parses a CPU list in the format of the kernel, eg: `0-3,8,10-11`.
+func ParseList(list string) ([]int, error) {
+	seen := map[int]bool{}
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if dash := strings.Index(part, "-"); dash >= 0 {
+			from, to = part[:dash], part[dash+1:]
+		}
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid CPU list '%s'", list)
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid CPU list '%s'", list)
+		}
+		for c := f; c <= t; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+	if len(cpus) <= 0 {
+		return nil, fmt.Errorf("empty CPU list '%s'", list)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// FormatList formats the CPUs as a list in the format of the kernel, eg: `0-3,8`.
+func FormatList(cpus []int) string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
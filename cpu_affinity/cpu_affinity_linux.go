@@ -0,0 +1,80 @@
+package cpu_affinity
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Max amount of CPUs of the masks, same as the glibc's cpu_set_t.
+const maxCpus = 1024
+
+type cpuMask [maxCpus / 64]uint64
+
+// Available returns the CPUs the daemon is allowed to run on, which the replicas can be pinned to.
+func Available() ([]int, error) {
+	var mask cpuMask
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); errno != 0 {
+		return nil, errno
+	}
+	var cpus []int
+	for c := 0; c < maxCpus; c++ {
+		if mask[c/64]&(1<<(c%64)) != 0 {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// Nodes returns the NUMA node of every CPU. It's empty when the machine doesn't report NUMA nodes.
+func Nodes() map[int]int {
+	nodes := map[int]int{}
+	dirs, _ := filepath.Glob("/sys/devices/system/node/node*")
+	for _, dir := range dirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			continue
+		}
+		cpus, err := ParseList(string(b))
+		if err != nil {
+			continue
+		}
+		for _, c := range cpus {
+			nodes[c] = node
+		}
+	}
+	return nodes
+}
+
+// Start starts the command pinned to the CPUs. The child is forked from a thread pinned to the CPUs, so it's pinned
+// from its very first instruction.
+func Start(cmd *exec.Cmd, cpus []int) error {
+	errChan := make(chan error)
+	go func() {
+		// Never unlocked: the thread is terminated once the goroutine exits, so its affinity doesn't leak to other
+		// goroutines.
+		runtime.LockOSThread()
+		var mask cpuMask
+		for _, c := range cpus {
+			if c >= 0 && c < maxCpus {
+				mask[c/64] |= 1 << (c % 64)
+			}
+		}
+		// PID 0 is the calling thread
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); errno != 0 {
+			errChan <- errno
+			return
+		}
+		errChan <- cmd.Start()
+	}()
+	return <-errChan
+}
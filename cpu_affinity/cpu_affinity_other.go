@@ -0,0 +1,22 @@
+//go:build !linux
+
+package cpu_affinity
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errNotSupported = errors.New("CPU affinity is only supported on linux")
+
+func Available() ([]int, error) {
+	return nil, errNotSupported
+}
+
+func Nodes() map[int]int {
+	return map[int]int{}
+}
+
+func Start(cmd *exec.Cmd, cpus []int) error {
+	return errNotSupported
+}
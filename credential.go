@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"rex-hive-daemon/hive_spec"
+	"strconv"
+)
+
+// processCredential is the user and groups a process runs as.
+type processCredential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	// description is the user and group as given in the spec, to be printed.
+	description string
+}
+
+// resolveCredential looks up the user and group of the process spec. Returns nil if the process runs as the daemon's
+// user and group, or an error if they don't exist or the daemon cannot switch to them.
+func resolveCredential(processSpec *hive_spec.ProcessSpec) (*processCredential, error) {
+	if processSpec.User == "" && processSpec.Group == "" {
+		return nil, nil
+	}
+
+	c := &processCredential{
+		uid:         uint32(os.Geteuid()),
+		gid:         uint32(os.Getegid()),
+		description: fmt.Sprintf("user '%s', group '%s'", processSpec.User, processSpec.Group),
+	}
+
+	if processSpec.User != "" {
+		u, err := lookupUser(processSpec.User)
+		if err != nil {
+			return nil, fmt.Errorf("process '%s': %w", processSpec.Name, err)
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		c.uid, c.gid = uint32(uid), uint32(gid)
+
+		// Supplementary groups of the user, best effort
+		if groupIds, err := u.GroupIds(); err == nil {
+			for _, g := range groupIds {
+				if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+					c.groups = append(c.groups, uint32(id))
+				}
+			}
+		}
+	}
+
+	if processSpec.Group != "" {
+		g, err := lookupGroup(processSpec.Group)
+		if err != nil {
+			return nil, fmt.Errorf("process '%s': %w", processSpec.Name, err)
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		c.gid = uint32(gid)
+	}
+
+	if err := checkCanSwitchTo(c); err != nil {
+		return nil, fmt.Errorf("process '%s': %w", processSpec.Name, err)
+	}
+	return c, nil
+}
+
+// lookupUser finds a user by name or numeric ID.
+func lookupUser(nameOrId string) (*user.User, error) {
+	if _, err := strconv.Atoi(nameOrId); err == nil {
+		return user.LookupId(nameOrId)
+	}
+	return user.Lookup(nameOrId)
+}
+
+// lookupGroup finds a group by name or numeric ID.
+func lookupGroup(nameOrId string) (*user.Group, error) {
+	if _, err := strconv.Atoi(nameOrId); err == nil {
+		return user.LookupGroupId(nameOrId)
+	}
+	return user.LookupGroup(nameOrId)
+}
+
+// checkWorkingDir verifies that the working dir of the process spec, if any, is an existing directory.
+func checkWorkingDir(processSpec *hive_spec.ProcessSpec) error {
+	if processSpec.WorkingDir == "" {
+		return nil
+	}
+	info, err := os.Stat(processSpec.WorkingDir)
+	if err != nil {
+		return fmt.Errorf("process '%s': invalid workingDir: %w", processSpec.Name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("process '%s': workingDir %s is not a directory", processSpec.Name, processSpec.WorkingDir)
+	}
+	return nil
+}
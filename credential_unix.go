@@ -0,0 +1,66 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Bits of the capabilities to switch user and group, see `man 7 capabilities`.
+const capSetGid = 6
+const capSetUid = 7
+
+// checkCanSwitchTo verifies the daemon is allowed to run processes with the given credential.
+func checkCanSwitchTo(c *processCredential) error {
+	euid := uint32(os.Geteuid())
+	if euid == 0 || isDaemonCredential(c) {
+		return nil
+	}
+
+	caps := effectiveCapabilities()
+	if caps&(1<<capSetUid) != 0 && caps&(1<<capSetGid) != 0 {
+		return nil
+	}
+	return fmt.Errorf("the daemon runs as uid %d and cannot switch to uid %d, gid %d; run it as root or with CAP_SETUID and CAP_SETGID", euid, c.uid, c.gid)
+}
+
+// isDaemonCredential tells if the credential has the user and group the daemon runs as. Such processes run without
+// switching credential, setting the supplementary groups would require CAP_SETGID.
+func isDaemonCredential(c *processCredential) bool {
+	return c.uid == uint32(os.Geteuid()) && c.gid == uint32(os.Getegid())
+}
+
+// effectiveCapabilities reads the effective capabilities of the daemon, zero if they can't be read.
+func effectiveCapabilities() uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "CapEff:") {
+			caps, _ := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return caps
+		}
+	}
+	return 0
+}
+
+// applyCredential makes the command run with the given credential, if not nil nor the daemon's.
+func applyCredential(cmd *exec.Cmd, c *processCredential) {
+	if c == nil || (os.Geteuid() != 0 && isDaemonCredential(c)) {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: c.uid, Gid: c.gid, Groups: c.groups}
+}
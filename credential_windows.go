@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func checkCanSwitchTo(c *processCredential) error {
+	return errors.New("running processes as another user or group is not supported on windows")
+}
+
+func applyCredential(cmd *exec.Cmd, c *processCredential) {}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"rex-hive-daemon/cpu_affinity"
+	"strings"
+)
+
+// printDryRun prints the fully expanded command line and env of every replica, as they would be spawned.
+func printDryRun(plans []*replicaPlan) {
+	fmt.Println(fmt.Sprintf("Dry run, total processes: %d", len(plans)))
+	for _, plan := range plans {
+		s := plan.spec
+		fmt.Println(fmt.Sprintf("[%d] process '%s', replica %d, restart: %s", plan.index, s.Name, plan.replica, s.Restart))
+		fmt.Println(fmt.Sprintf("  cmd: %s %s", s.Cmd[0].Value, strings.Join(plan.displayArgs(), " ")))
+		if s.WorkingDir != "" {
+			fmt.Println(fmt.Sprintf("  workingDir: %s", s.WorkingDir))
+		}
+		if plan.credential != nil {
+			fmt.Println(fmt.Sprintf("  runs as: %s (uid %d, gid %d)", plan.credential.description, plan.credential.uid, plan.credential.gid))
+		}
+		if s.ForwardOsEnv.Enabled {
+			fmt.Println(fmt.Sprintf("  env: (OS env vars are forwarded, include: %v, exclude: %v)", s.ForwardOsEnv.Include, s.ForwardOsEnv.Exclude))
+		}
+		printDryRunEnv(plan)
+		if len(plan.cpus) > 0 {
+			fmt.Println(fmt.Sprintf("  cpuAffinity: %s", cpu_affinity.FormatList(plan.cpus)))
+		}
+		if s.Resources != nil {
+			fmt.Println(fmt.Sprintf("  resources: %s", describeResources(s.Resources)))
+		}
+		if s.Metrics != nil {
+			fmt.Println(fmt.Sprintf("  metrics: every %s", s.Metrics.Interval))
+		}
+		if s.Tty {
+			fmt.Println("  tty: true")
+		}
+		if s.Stdin != nil {
+			switch {
+			case s.Stdin.Interactive:
+				fmt.Println("  stdin: interactive")
+			case s.Stdin.File != "":
+				fmt.Println(fmt.Sprintf("  stdin: file %s", s.Stdin.File))
+			default:
+				fmt.Println(fmt.Sprintf("  stdin: text (%d bytes)", len(s.Stdin.Text)))
+			}
+		}
+	}
+}
+
+// printDryRunEnv prints the env vars of the replica as they would be resolved when spawning it, envFrom sources
+// included. Sensitive values are masked and the values of the forwarded OS env vars are never printed.
+func printDryRunEnv(plan *replicaPlan) {
+	s := plan.spec
+	env := newProcessEnv(func(msg string) { fmt.Println(fmt.Sprintf("  env: (%s)", msg)) })
+	env.forwardOsEnv(os.Environ(), &s.ForwardOsEnv)
+	if _, err := env.envFrom(s.EnvFrom); err != nil {
+		fmt.Println(fmt.Sprintf("  env: (%s)", err.Error()))
+	}
+	for _, envEntry := range s.Env {
+		env.set(envEntry.Name, envEntry.Value, "spec", envEntry.Sensitive)
+	}
+	for _, v := range env.vars {
+		switch v.source {
+		case "OS":
+		case "spec":
+			fmt.Println(fmt.Sprintf("  env: %s=%s", v.name, v.displayValue()))
+		default:
+			fmt.Println(fmt.Sprintf("  env: %s=%s (from %s)", v.name, v.displayValue(), v.source))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/redact"
+	"sort"
+	"strings"
+)
+
+// envVar is a single entry of the env of a process, along with where it comes from.
+type envVar struct {
+	name   string
+	value  string
+	source string
+	// sensitive values are masked when printed
+	sensitive bool
+}
+
+// processEnv is the env of a process. Setting a var that already exists replaces its value in place, so the order
+// of the vars is deterministic and there are never duplicate names.
+type processEnv struct {
+	vars    []*envVar
+	byName  map[string]*envVar
+	printer func(msg string)
+	// Whether the spec sets up the env at all, through env, envFrom or forwardOsEnv
+	configured bool
+}
+
+func newProcessEnv(printer func(msg string)) *processEnv {
+	return &processEnv{byName: map[string]*envVar{}, printer: printer}
+}
+
+// set adds a var, or overrides the value of an existing var with the same name.
+func (e *processEnv) set(name string, value string, source string, sensitive bool) {
+	e.configured = true
+	if v, ok := e.byName[name]; ok {
+		e.printer(fmt.Sprintf("env %s from %s overrides the one from %s", name, source, v.source))
+		v.value, v.source, v.sensitive = value, source, sensitive
+		return
+	}
+	v := &envVar{name: name, value: value, source: source, sensitive: sensitive}
+	e.vars = append(e.vars, v)
+	e.byName[name] = v
+}
+
+// forwardOsEnv adds the OS env vars selected by the spec. Their values are never printed, they may hold secrets.
+func (e *processEnv) forwardOsEnv(osEnv []string, forward *hive_spec.ForwardOsEnv) {
+	if !forward.Enabled {
+		return
+	}
+	e.configured = true
+	count := 0
+	for _, kv := range osEnv {
+		name, value, _ := strings.Cut(kv, "=")
+		if forward.Forwards(name) {
+			e.set(name, value, "OS", true)
+			count++
+		}
+	}
+	e.printer(fmt.Sprintf("forwarding %d of %d OS env vars", count, len(osEnv)))
+}
+
+// envFrom adds the vars of each source, in order. Returns the values of the sensitive sources.
+func (e *processEnv) envFrom(sources []*hive_spec.EnvFromSource) (sensitive []string, err error) {
+	if len(sources) > 0 {
+		e.configured = true
+	}
+	for _, source := range sources {
+		values, err := source.Values()
+		if err != nil {
+			return nil, fmt.Errorf("cannot load env from %s: %w", source.Describe(), err)
+		}
+
+		// Sort names, maps have no order
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			e.set(name, values[name], source.Describe(), source.Sensitive)
+			if source.Sensitive {
+				sensitive = append(sensitive, values[name])
+			}
+		}
+		e.printer(fmt.Sprintf("loaded %d env vars from %s", len(values), source.Describe()))
+	}
+	return sensitive, nil
+}
+
+// displayValue returns the value of the var, masked if it's sensitive.
+func (v *envVar) displayValue() string {
+	if v.sensitive {
+		return redact.Mask(v.value)
+	}
+	return v.value
+}
+
+// environ returns the vars in the `name=value` format of `exec.Cmd.Env`. Nil when the spec doesn't set up the env, so
+// the process inherits all the vars of the daemon. Otherwise the process only gets the vars in its env.
+func (e *processEnv) environ() []string {
+	if !e.configured {
+		return nil
+	}
+	environ := make([]string, 0, len(e.vars))
+	for _, v := range e.vars {
+		environ = append(environ, fmt.Sprintf("%s=%s", v.name, v.value))
+	}
+	return environ
+}
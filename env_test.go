@@ -0,0 +1,86 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"rex-hive-daemon/hive_spec"
+	"strings"
+	"testing"
+)
+
+func TestProcessEnv(t *testing.T) {
+	dotenv := filepath.Join(t.TempDir(), "server.env")
+	if err := os.WriteFile(dotenv, []byte("PORT=7000\nMAP=file\nFILE=1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	osEnv := []string{"HOME=/root", "PORT=6000", "PATH=/bin", "SECRET=os"}
+
+	tests := []struct {
+		name string
+		spec string
+		want []string
+		// Vars whose values are masked when printed
+		wantSensitive []string
+	}{
+		{"not configured inherits the daemon's env", `{}`, nil, nil},
+		{"forwarded OS env", `forwardOsEnv: true`, osEnv, []string{"HOME", "PORT", "PATH", "SECRET"}},
+		{"forwarded OS env patterns", `forwardOsEnv: {include: ["P*", "SECRET"], exclude: ["PATH"]}`, []string{
+			"PORT=6000", "SECRET=os",
+		}, []string{"PORT", "SECRET"}},
+		{"envFrom overrides forwarded OS env, later sources override earlier ones", `
+forwardOsEnv: {include: ["PORT"]}
+envFrom:
+  - file: ` + dotenv + `
+  - {configMap: shared, sensitive: true}`, []string{
+			"PORT=8000", "FILE=1", "MAP=shared", "ONLY_MAP=1",
+		}, []string{"PORT", "MAP", "ONLY_MAP"}},
+		{"env overrides everything", `
+forwardOsEnv: true
+envFrom:
+  - file: ` + dotenv + `
+env:
+  - {name: PORT, value: "9000"}
+  - {name: SECRET, value: "spec"}
+  - {name: TOKEN, value: "xxxx", sensitive: true}`, []string{
+			"HOME=/root", "PORT=9000", "PATH=/bin", "SECRET=spec", "FILE=1", "MAP=file", "TOKEN=xxxx",
+		}, []string{"HOME", "PATH", "TOKEN"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hiveSpec := &hive_spec.HiveSpec{}
+			spec := "spec:\n  configMaps:\n    - {name: shared, data: {PORT: \"8000\", MAP: shared, ONLY_MAP: \"1\"}}\n  processes:\n    - "
+			if err := yaml.Unmarshal([]byte(spec+strings.ReplaceAll(tt.spec, "\n", "\n      ")), hiveSpec); err != nil {
+				t.Fatal(err)
+			}
+			if err := hiveSpec.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			s := hiveSpec.Spec.Processes[0]
+
+			// Same order as when spawning a replica
+			env := newProcessEnv(func(string) {})
+			env.forwardOsEnv(osEnv, &s.ForwardOsEnv)
+			if _, err := env.envFrom(s.EnvFrom); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range s.Env {
+				env.set(e.Name, e.Value, "spec", e.Sensitive)
+			}
+
+			if got := env.environ(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("environ() = %q, want %q", got, tt.want)
+			}
+			var sensitive []string
+			for _, v := range env.vars {
+				if v.sensitive {
+					sensitive = append(sensitive, v.name)
+				}
+			}
+			if !reflect.DeepEqual(sensitive, tt.wantSensitive) {
+				t.Errorf("sensitive vars = %q, want %q", sensitive, tt.wantSensitive)
+			}
+		})
+	}
+}
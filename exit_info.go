@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"rex-hive-daemon/hive_message"
+	"time"
+)
+
+// exitInfoOf returns how the process terminated and the resources it used, given how long it ran.
+func exitInfoOf(state *os.ProcessState, runtime time.Duration) *hive_message.ExitInfo {
+	signal, coreDumped := exitSignal(state)
+	return &hive_message.ExitInfo{
+		Signal:      signal,
+		CoreDumped:  coreDumped,
+		UserCpuMs:   state.UserTime().Milliseconds(),
+		SystemCpuMs: state.SystemTime().Milliseconds(),
+		MaxRssBytes: maxRssBytes(state),
+		RuntimeMs:   runtime.Milliseconds(),
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// exitSignal always returns no signal, processes aren't terminated by signals on windows.
+func exitSignal(state *os.ProcessState) (string, bool) {
+	return "", false
+}
+
+func maxRssBytes(state *os.ProcessState) int64 {
+	return 0
+}
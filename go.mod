@@ -1,6 +1,6 @@
 module rex-hive-daemon
 
-go 1.19
+go 1.20
 
 require (
 	github.com/golang/snappy v0.0.1 // indirect
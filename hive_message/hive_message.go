@@ -1,33 +1,66 @@
 package hive_message
 
 import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"rex-hive-daemon/machine_meta"
+	"rex-hive-daemon/proc_metrics"
 	"time"
 )
 
-type hiveMessageType string
+type HiveMessageType string
 
 const (
-	ProcessAborted hiveMessageType = "aborted"
-	ProcessStarted hiveMessageType = "started"
-	ProcessExited  hiveMessageType = "exited"
-	ProcessStdOut  hiveMessageType = "stdout"
-	ProcessStdErr  hiveMessageType = "stderr"
+	ProcessAborted HiveMessageType = "aborted"
+	ProcessStarted HiveMessageType = "started"
+	ProcessExited  HiveMessageType = "exited"
+	ProcessStdOut  HiveMessageType = "stdout"
+	ProcessStdErr  HiveMessageType = "stderr"
+	// ProcessOomKilled is sent before ProcessExited when the kernel killed the process for exceeding its memoryMax.
+	ProcessOomKilled HiveMessageType = "oom-killed"
+	// ProcessMetrics is sent periodically with a sample of the resource usage of the process.
+	ProcessMetrics HiveMessageType = "metrics"
 )
 
 type HiveMessage struct {
-	// TempId is a temp UUID assigned at runtime before storing it to mongo DB. It's not persisted in MongoDB.
-	// The actual ID of these entities will be a MongoDB ObjectID which is faster and works better for message logs
-	// which can be stored a rates of hundreds per second. ObjectIDs also work better at keeping the order in which
-	// entities are stored which is important when storing and retrieving log messages.
-	TempId         string                    `bson:"-"`
-	Index          int                       `bson:"index"`
-	Pid            int                       `bson:"pid"`
-	Attempt        int                       `bson:"attempt"`
-	Type           hiveMessageType           `bson:"type"`
-	Data           string                    `bson:"data,omitempty"`
-	ExitCode       int                       `bson:"exitCode"`
+	// Id is a MongoDB ObjectID assigned once, when the message is buffered, so writing a batch again after a partial
+	// failure doesn't store its messages twice. ObjectIDs are faster and work better for message logs which can be
+	// stored a rates of hundreds per second. ObjectIDs also work better at keeping the order in which entities are
+	// stored which is important when storing and retrieving log messages.
+	Id      primitive.ObjectID `bson:"_id,omitempty"`
+	Index   int                `bson:"index"`
+	Pid     int                `bson:"pid"`
+	Attempt int                `bson:"attempt"`
+	Type    HiveMessageType    `bson:"type"`
+	Data    string             `bson:"data,omitempty"`
+	// Continued is true when Data is a chunk of a line too long to fit in one message, and the next message of the same
+	// type, index and attempt continues it.
+	Continued bool `bson:"continued,omitempty"`
+	ExitCode  int  `bson:"exitCode"`
+	// CpuAffinity is the CPUs the process is pinned to, only set in ProcessStarted messages.
+	CpuAffinity []int `bson:"cpuAffinity,omitempty"`
+	// Exit is how the process terminated and the resources it used, only set in ProcessExited messages.
+	Exit *ExitInfo `bson:"exit,omitempty"`
+	// Metrics is the resource usage of the process, only set in ProcessMetrics messages.
+	Metrics *proc_metrics.Metrics `bson:"metrics,omitempty"`
+	// Level, Message, Timestamp and Fields are parsed from the output lines of processes with a `json` log format.
+	// Fields holds the keys of the line other than the level, message and timestamp.
+	Level          string                    `bson:"level,omitempty"`
+	Message        string                    `bson:"message,omitempty"`
+	Timestamp      *time.Time                `bson:"timestamp,omitempty"`
+	Fields         map[string]interface{}    `bson:"fields,omitempty"`
 	HiveRunId      interface{}               `bson:"hiveRunId"`
 	RuntimeMachine *machine_meta.MachineMeta `bson:"runtimeMachine,omitempty"`
 	Time           time.Time                 `bson:"time"`
 }
+
+// ExitInfo describes how a process terminated and the resources it used over its whole run.
+type ExitInfo struct {
+	// Signal is the name of the signal that terminated the process, eg: `SIGSEGV`, empty if it exited by itself.
+	Signal      string `bson:"signal,omitempty"`
+	CoreDumped  bool   `bson:"coreDumped"`
+	UserCpuMs   int64  `bson:"userCpuMs"`
+	SystemCpuMs int64  `bson:"systemCpuMs"`
+	// MaxRssBytes is the peak resident memory of the process, or of its largest child when they're waited for.
+	MaxRssBytes int64 `bson:"maxRssBytes,omitempty"`
+	RuntimeMs   int64 `bson:"runtimeMs"`
+}
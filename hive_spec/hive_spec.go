@@ -1,9 +1,17 @@
 package hive_spec
 
 import (
+	"fmt"
+	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
 	"os"
+	"path"
+	"regexp"
+	"rex-hive-daemon/cpu_affinity"
 	"rex-hive-daemon/machine_meta"
+	"rex-hive-daemon/redact"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,21 +19,478 @@ type ProcessSpec struct {
 	Name string `bson:"name"`
 	// ForwardOsEnv when set to true, will forward all the OS env vars (`os.Environ()`) to the process.
 	// If instead of running a compiled binary, you're running `go run` e.g: `go run my-main.go`, you need to set this
-	// to true.
-	ForwardOsEnv bool `yaml:"forwardOsEnv" bson:"forwardOsEnv"`
+	// to true. It can also be a mapping with `include` and `exclude` glob patterns, to only forward some of the vars.
+	// Env entries of the spec always override forwarded vars with the same name.
+	ForwardOsEnv ForwardOsEnv `yaml:"forwardOsEnv" bson:"forwardOsEnv"`
 	Env          []struct {
-		Name      string `bson:"name"`
-		Value     string `bson:"value"`
+		Name  string `bson:"name"`
+		Value string `bson:"value"`
+		// Sensitive values are masked when printed and stored.
+		Sensitive bool `bson:"sensitive,omitempty"`
 		ValueFrom struct {
 			SecretKeyRef struct {
 				Name string `bson:"name"`
 				Key  string `bson:"key"`
-			} `bson:"secretKeyRef"`
-		} `bson:"valueFrom"`
+			} `yaml:"secretKeyRef" bson:"secretKeyRef"`
+		} `yaml:"valueFrom" bson:"valueFrom"`
 	} `bson:"env"`
-	Cmd      []string `bson:"cmd"`
-	Restart  string   `bson:"restart"`
-	Replicas int      `bson:"replicas"`
+	// EnvFrom loads env vars from dotenv files, read each time the process is spawned so restarts pick up edits, or
+	// from config maps of the spec. Entries later in the list override earlier ones, and Env overrides them all.
+	EnvFrom []*EnvFromSource `yaml:"envFrom" bson:"envFrom,omitempty"`
+	Cmd     []CmdArg         `bson:"cmd"`
+	// WorkingDir is the directory the process runs in. Defaults to the daemon's working directory.
+	WorkingDir string `yaml:"workingDir" bson:"workingDir,omitempty"`
+	// User and Group, names or numeric IDs, the process runs as. Default to the daemon's. Switching requires the
+	// daemon to run as root or with the CAP_SETUID and CAP_SETGID capabilities.
+	User     string `bson:"user,omitempty"`
+	Group    string `bson:"group,omitempty"`
+	Restart  string `bson:"restart"`
+	Replicas int    `bson:"replicas"`
+	// Redact masks the matches of these patterns in the output of the process before printing or storing it. Of the
+	// patterns with capturing groups only the groups are masked.
+	Redact []*RedactPattern `bson:"redact,omitempty"`
+	// Resources limits the memory, CPU, processes and open files of each replica.
+	Resources *ResourcesSpec `bson:"resources,omitempty"`
+	// CpuAffinity pins each replica to a set of CPUs.
+	CpuAffinity *CpuAffinitySpec `yaml:"cpuAffinity" bson:"cpuAffinity,omitempty"`
+	// Stdin configures what the process reads from its standard input. When not set, the process reads from the null
+	// device.
+	Stdin *StdinSpec `bson:"stdin,omitempty"`
+	// Tty runs the process under a pseudo-terminal, for processes that buffer their output when not attached to one.
+	// Stdout and stderr are merged into stdout.
+	Tty        bool        `bson:"tty,omitempty"`
+	TtyOptions *TtyOptions `yaml:"ttyOptions" bson:"ttyOptions,omitempty"`
+	// MaxLineLength is the max amount of bytes of an output line in a single message, longer lines are split in
+	// multiple messages. Defaults to DefaultMaxLineLength.
+	MaxLineLength int `yaml:"maxLineLength" bson:"maxLineLength,omitempty"`
+	// Multiline merges consecutive output lines, like the lines of a crash callstack, into a single message.
+	Multiline *MultilineSpec `bson:"multiline,omitempty"`
+	// LogFormat is the format of the output lines of the process, either `text` (default) or `json`. JSON lines are
+	// parsed into the level, message, timestamp and fields of the messages.
+	LogFormat string `yaml:"logFormat" bson:"logFormat,omitempty"`
+	// Metrics samples the CPU, memory, threads, open files and I/O of every replica periodically.
+	Metrics *MetricsSpec `bson:"metrics,omitempty"`
+	// Logs writes the output of every replica to files on disk, regardless of the messages being stored in DB.
+	Logs *LogsSpec `bson:"logs,omitempty"`
+}
+
+const DefaultLogsMaxSizeMB = 100
+const DefaultLogsMaxFiles = 5
+
+// LogsSpec defines where and how the output of the replicas is written to disk. Each replica writes to
+// `<dir>/<name>-<index>.log`, or `<dir>/<name>-<index>/<attempt>.log` when PerAttempt is set. Files are rotated once
+// they reach MaxSizeMB, keeping up to MaxFiles rotated files, gzipped if Compress is set. With PerAttempt, the files
+// of up to MaxFiles previous attempts are kept.
+type LogsSpec struct {
+	Dir        string `yaml:"dir" bson:"dir"`
+	MaxSizeMB  int    `yaml:"maxSizeMB" bson:"maxSizeMB,omitempty"`
+	MaxFiles   int    `yaml:"maxFiles" bson:"maxFiles,omitempty"`
+	Compress   bool   `yaml:"compress" bson:"compress,omitempty"`
+	PerAttempt bool   `yaml:"perAttempt" bson:"perAttempt,omitempty"`
+}
+
+const LogFormatText = "text"
+const LogFormatJson = "json"
+
+const DefaultMaxLineLength = 64 * 1024
+
+const DefaultTtyColumns = 80
+const DefaultTtyRows = 24
+
+type TtyOptions struct {
+	// KeepAnsi keeps the ANSI escape sequences (colors, cursor movement) in the captured output. They're stripped by
+	// default.
+	KeepAnsi bool `yaml:"keepAnsi" bson:"keepAnsi,omitempty"`
+	Columns  int  `bson:"columns,omitempty"`
+	Rows     int  `bson:"rows,omitempty"`
+}
+
+// ForwardOsEnv selects the OS env vars forwarded to a process. A var is forwarded if it matches any of the Include
+// patterns, or Include is empty, and it matches none of the Exclude patterns. Patterns are globs, eg: `REX_*`.
+type ForwardOsEnv struct {
+	Enabled bool     `yaml:"-" bson:"enabled"`
+	Include []string `yaml:"include" bson:"include,omitempty"`
+	Exclude []string `yaml:"exclude" bson:"exclude,omitempty"`
+}
+
+func (f *ForwardOsEnv) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Enabled)
+	}
+
+	// Use an alias type to decode the mapping without recursing into this method
+	type plain ForwardOsEnv
+	if err := value.Decode((*plain)(f)); err != nil {
+		return err
+	}
+	f.Enabled = true
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("line %d: invalid forwardOsEnv pattern '%s': %w", value.Line, pattern, err)
+		}
+	}
+	return nil
+}
+
+// Forwards tells if the OS env var with the given name is forwarded.
+func (f *ForwardOsEnv) Forwards(name string) bool {
+	if !f.Enabled {
+		return false
+	}
+	return (len(f.Include) <= 0 || matchesAny(f.Include, name)) && !matchesAny(f.Exclude, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EnvFromSource is either a dotenv `file` or the name of a `configMap` of the spec. Sensitive values are masked in the
+// output of the process.
+type EnvFromSource struct {
+	File      string `yaml:"file" bson:"file,omitempty"`
+	ConfigMap string `yaml:"configMap" bson:"configMap,omitempty"`
+	Sensitive bool   `yaml:"sensitive" bson:"sensitive,omitempty"`
+	// Set by Validate
+	configMap *ConfigMap
+}
+
+// Values reads the env vars of the source.
+func (e *EnvFromSource) Values() (map[string]string, error) {
+	if e.File != "" {
+		return godotenv.Read(e.File)
+	}
+	if e.configMap == nil {
+		return nil, fmt.Errorf("config map '%s' not found", e.ConfigMap)
+	}
+	return e.configMap.Data, nil
+}
+
+// Describe returns a short description of the source, eg: `file ./server.env`.
+func (e *EnvFromSource) Describe() string {
+	if e.File != "" {
+		return "file " + e.File
+	}
+	return "config map " + e.ConfigMap
+}
+
+// ConfigMap is a named set of env vars shared by the processes of a spec.
+type ConfigMap struct {
+	Name string            `yaml:"name" bson:"name"`
+	Data map[string]string `yaml:"data" bson:"data"`
+}
+
+// ResourcesSpec limits the resources of each replica. MemoryMax is a size with an optional K, M, G or T suffix, eg:
+// `512M`, CpuMax is an amount of CPUs, eg: `1.5`, PidsMax the max amount of processes and threads, and Nofile the max
+// amount of open files.
+type ResourcesSpec struct {
+	MemoryMax string `yaml:"memoryMax" bson:"memoryMax,omitempty"`
+	CpuMax    string `yaml:"cpuMax" bson:"cpuMax,omitempty"`
+	PidsMax   int64  `yaml:"pidsMax" bson:"pidsMax,omitempty"`
+	Nofile    uint64 `yaml:"nofile" bson:"nofile,omitempty"`
+	// Parsed values, populated when parsing the spec
+	MemoryMaxBytes int64   `yaml:"-" bson:"-"`
+	CpuMaxCpus     float64 `yaml:"-" bson:"-"`
+}
+
+var memorySizeRegex = regexp.MustCompile(`^(\d+)\s*([KMGT]?)I?B?$`)
+
+func (r *ResourcesSpec) UnmarshalYAML(value *yaml.Node) error {
+	type plain ResourcesSpec
+	if err := value.Decode((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.MemoryMax != "" {
+		m := memorySizeRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(r.MemoryMax)))
+		if m == nil {
+			return fmt.Errorf("line %d: invalid memoryMax '%s', expected eg. '512M' or '2G'", value.Line, r.MemoryMax)
+		}
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		shift := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}[m[2]]
+		r.MemoryMaxBytes = n << shift
+	}
+	if r.CpuMax != "" {
+		cpus, err := strconv.ParseFloat(r.CpuMax, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("line %d: invalid cpuMax '%s', expected an amount of CPUs eg. '1.5'", value.Line, r.CpuMax)
+		}
+		r.CpuMaxCpus = cpus
+	}
+	if r.PidsMax < 0 {
+		return fmt.Errorf("line %d: invalid pidsMax %d", value.Line, r.PidsMax)
+	}
+	return nil
+}
+
+// CpuAffinitySpec is either a list of CPUs all the replicas are pinned to, eg: `0-3,8` or `[0, 1, 2, 3]`, or `{auto: n}`
+// for the daemon to pin each replica to n CPUs of its own, not shared with any other pinned replica.
+type CpuAffinitySpec struct {
+	Cpus []int `yaml:"-" bson:"cpus,omitempty"`
+	Auto int   `yaml:"auto" bson:"auto,omitempty"`
+}
+
+func (c *CpuAffinitySpec) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		cpus, err := cpu_affinity.ParseList(value.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", value.Line, err)
+		}
+		c.Cpus = cpus
+		return nil
+	case yaml.SequenceNode:
+		var cpus []int
+		if err := value.Decode(&cpus); err != nil {
+			return err
+		}
+		parsed, err := cpu_affinity.ParseList(cpu_affinity.FormatList(cpus))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", value.Line, err)
+		}
+		c.Cpus = parsed
+		return nil
+	}
+
+	type plain CpuAffinitySpec
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Auto <= 0 {
+		return fmt.Errorf("line %d: cpuAffinity auto must be greater than 0", value.Line)
+	}
+	return nil
+}
+
+// CmdArg is either a plain string, or a mapping with a `value` and `sensitive: true` for values that must be masked
+// when printed.
+type CmdArg struct {
+	Value     string `yaml:"value" bson:"value"`
+	Sensitive bool   `yaml:"sensitive" bson:"sensitive,omitempty"`
+}
+
+func (a *CmdArg) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		a.Value = value.Value
+		return nil
+	}
+
+	type plain CmdArg
+	return value.Decode((*plain)(a))
+}
+
+// SensitiveEnvValues returns the values of the env entries that must be masked when printed.
+func (s *ProcessSpec) SensitiveEnvValues() []string {
+	var values []string
+	for _, e := range s.Env {
+		if e.Sensitive {
+			values = append(values, e.Value)
+		}
+	}
+	return values
+}
+
+// Redacted returns a copy of the spec with the sensitive env values and args, and the data of the config maps loaded
+// by sensitive envFrom entries, masked. The copy is the one to store, the original is the one to run.
+func (h *HiveSpec) Redacted() *HiveSpec {
+	c := *h
+	sensitiveConfigMaps := map[string]bool{}
+	c.Spec.Processes = make([]*ProcessSpec, len(h.Spec.Processes))
+	for i, s := range h.Spec.Processes {
+		p := *s
+		p.Env = append(p.Env[:0:0], s.Env...)
+		for j, e := range p.Env {
+			if e.Sensitive {
+				p.Env[j].Value = redact.Mask(e.Value)
+			}
+		}
+		p.Cmd = append(p.Cmd[:0:0], s.Cmd...)
+		for j, a := range p.Cmd {
+			if a.Sensitive {
+				p.Cmd[j].Value = redact.Mask(a.Value)
+			}
+		}
+		for _, e := range s.EnvFrom {
+			if e.Sensitive && e.ConfigMap != "" {
+				sensitiveConfigMaps[e.ConfigMap] = true
+			}
+		}
+		c.Spec.Processes[i] = &p
+	}
+
+	c.Spec.ConfigMaps = make([]*ConfigMap, len(h.Spec.ConfigMaps))
+	for i, m := range h.Spec.ConfigMaps {
+		if !sensitiveConfigMaps[m.Name] {
+			c.Spec.ConfigMaps[i] = m
+			continue
+		}
+		masked := &ConfigMap{Name: m.Name, Data: make(map[string]string, len(m.Data))}
+		for k, v := range m.Data {
+			masked.Data[k] = redact.Mask(v)
+		}
+		c.Spec.ConfigMaps[i] = masked
+	}
+	return &c
+}
+
+// RedactPattern is a regular expression, compiled when parsing the spec.
+type RedactPattern struct {
+	Pattern string         `bson:"pattern"`
+	Regex   *regexp.Regexp `bson:"-"`
+}
+
+func (r *RedactPattern) UnmarshalYAML(value *yaml.Node) error {
+	if err := value.Decode(&r.Pattern); err != nil {
+		return err
+	}
+	var err error
+	if r.Regex, err = regexp.Compile(r.Pattern); err != nil {
+		return fmt.Errorf("line %d: invalid redact pattern: %w", value.Line, err)
+	}
+	return nil
+}
+
+const stdinInteractive = "interactive"
+
+// StdinSpec is either `stdin: interactive`, which keeps the stdin open so lines can be written to it through the
+// control API, or a mapping with either a `file` or a `text` to feed the process with.
+type StdinSpec struct {
+	File        string `yaml:"file" bson:"file,omitempty"`
+	Text        string `yaml:"text" bson:"text,omitempty"`
+	Interactive bool   `yaml:"-" bson:"interactive,omitempty"`
+}
+
+func (s *StdinSpec) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		if value.Value != stdinInteractive {
+			return fmt.Errorf("line %d: invalid stdin '%s', expected '%s' or a mapping with 'file' or 'text'", value.Line, value.Value, stdinInteractive)
+		}
+		s.Interactive = true
+		return nil
+	}
+
+	type plain StdinSpec
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	if s.File != "" && s.Text != "" {
+		return fmt.Errorf("line %d: stdin can have either 'file' or 'text', not both", value.Line)
+	}
+	return nil
+}
+
+const DefaultMetricsInterval = 10 * time.Second
+
+// MetricsSpec defines how often the resource usage of the replicas is sampled.
+type MetricsSpec struct {
+	Interval time.Duration `yaml:"interval" bson:"interval,omitempty"`
+}
+
+func (m *MetricsSpec) UnmarshalYAML(value *yaml.Node) error {
+	type plain MetricsSpec
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	if m.Interval <= 0 {
+		m.Interval = DefaultMetricsInterval
+	}
+	return nil
+}
+
+const DefaultMultilineMaxLines = 500
+const DefaultMultilineFlushTimeout = time.Second
+
+// MultilineSpec defines how output lines are grouped. When Continuation is set, lines matching it are appended to the
+// current group and any other line starts a new one. Otherwise, lines matching Start begin a new group and any other
+// line is appended to the current one. A group is sent once it reaches MaxLines, or when no line is added to it for
+// FlushTimeout.
+type MultilineSpec struct {
+	Start        string        `yaml:"start" bson:"start,omitempty"`
+	Continuation string        `yaml:"continuation" bson:"continuation,omitempty"`
+	MaxLines     int           `yaml:"maxLines" bson:"maxLines,omitempty"`
+	FlushTimeout time.Duration `yaml:"flushTimeout" bson:"flushTimeout,omitempty"`
+	// Compiled patterns, populated when parsing the spec
+	StartRegex        *regexp.Regexp `yaml:"-" bson:"-"`
+	ContinuationRegex *regexp.Regexp `yaml:"-" bson:"-"`
+}
+
+func (m *MultilineSpec) UnmarshalYAML(value *yaml.Node) error {
+	type plain MultilineSpec
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	if m.Start == "" && m.Continuation == "" {
+		return fmt.Errorf("line %d: multiline requires a 'start' or a 'continuation' pattern", value.Line)
+	}
+
+	var err error
+	if m.Start != "" {
+		if m.StartRegex, err = regexp.Compile(m.Start); err != nil {
+			return fmt.Errorf("line %d: invalid multiline start pattern: %w", value.Line, err)
+		}
+	}
+	if m.Continuation != "" {
+		if m.ContinuationRegex, err = regexp.Compile(m.Continuation); err != nil {
+			return fmt.Errorf("line %d: invalid multiline continuation pattern: %w", value.Line, err)
+		}
+	}
+	if m.MaxLines <= 0 {
+		m.MaxLines = DefaultMultilineMaxLines
+	}
+	if m.FlushTimeout <= 0 {
+		m.FlushTimeout = DefaultMultilineFlushTimeout
+	}
+	return nil
+}
+
+const (
+	SinkMongo = "mongo"
+	SinkOtlp  = "otlp"
+)
+
+const DefaultSinkBatchSize = 200
+const DefaultSinkInterval = time.Second
+const DefaultSinkMaxBuffered = 100000
+const DefaultSinkHeartbeatInterval = 30 * time.Second
+
+// SinkSpec selects a destination of the messages. Each sink buffers up to MaxBuffered messages of its own, dropping
+// the oldest ones when full, and writes them in batches of up to BatchSize every Interval, so a failing sink doesn't
+// hold back the others. The mongo sink also writes a heartbeat of the machine every HeartbeatInterval.
+type SinkSpec struct {
+	Type              string        `yaml:"type" bson:"type"`
+	BatchSize         int           `yaml:"batchSize" bson:"batchSize,omitempty"`
+	Interval          time.Duration `yaml:"interval" bson:"interval,omitempty"`
+	MaxBuffered       int           `yaml:"maxBuffered" bson:"maxBuffered,omitempty"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval" bson:"heartbeatInterval,omitempty"`
+}
+
+func (s *SinkSpec) UnmarshalYAML(value *yaml.Node) error {
+	type plain SinkSpec
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.SetDefaults()
+	return nil
+}
+
+// SetDefaults sets the default values of the fields that aren't set.
+func (s *SinkSpec) SetDefaults() {
+	if s.BatchSize <= 0 {
+		s.BatchSize = DefaultSinkBatchSize
+	}
+	if s.Interval <= 0 {
+		s.Interval = DefaultSinkInterval
+	}
+	if s.MaxBuffered <= 0 {
+		s.MaxBuffered = DefaultSinkMaxBuffered
+	}
+	if s.HeartbeatInterval <= 0 {
+		s.HeartbeatInterval = DefaultSinkHeartbeatInterval
+	}
 }
 
 // HiveSpec is the formal definition of how one or multiple processes will run in a machine. Once a HiveSpec is executed
@@ -38,7 +503,11 @@ type HiveSpec struct {
 		Name string `bson:"name"`
 	} `bson:"metadata"`
 	Spec struct {
-		Processes []*ProcessSpec `yaml:"processes" bson:"processes"`
+		Processes  []*ProcessSpec `yaml:"processes" bson:"processes"`
+		ConfigMaps []*ConfigMap   `yaml:"configMaps" bson:"configMaps,omitempty"`
+		// Sinks are where the messages of the run are sent. Defaults to mongo when USE_MONGO=1 and to otlp when an
+		// OTLP endpoint is set.
+		Sinks []*SinkSpec `yaml:"sinks" bson:"sinks,omitempty"`
 	} `bson:"spec"`
 	// This field os not populated by the yml spec but at run time
 	RuntimeMachine *machine_meta.MachineMeta `bson:"runtimeMachine,omitempty"`
@@ -60,5 +529,60 @@ func FromFile(filename string) (*HiveSpec, error) {
 		return nil, err
 	}
 
+	if err = data.Validate(); err != nil {
+		return nil, err
+	}
+
 	return data, err
 }
+
+// Validate checks the values that can't be checked while parsing the spec, and links the envFrom entries to their
+// config maps.
+func (h *HiveSpec) Validate() error {
+	configMaps := map[string]*ConfigMap{}
+	for _, c := range h.Spec.ConfigMaps {
+		if _, ok := configMaps[c.Name]; ok {
+			return fmt.Errorf("duplicate config map '%s'", c.Name)
+		}
+		configMaps[c.Name] = c
+	}
+
+	sinks := map[string]bool{}
+	for _, s := range h.Spec.Sinks {
+		switch s.Type {
+		case SinkMongo, SinkOtlp:
+		default:
+			return fmt.Errorf("invalid sink type '%s', expected '%s' or '%s'", s.Type, SinkMongo, SinkOtlp)
+		}
+		if sinks[s.Type] {
+			return fmt.Errorf("duplicate sink '%s'", s.Type)
+		}
+		sinks[s.Type] = true
+	}
+
+	for _, s := range h.Spec.Processes {
+		switch s.LogFormat {
+		case "", LogFormatText, LogFormatJson:
+		default:
+			return fmt.Errorf("process '%s': invalid logFormat '%s', expected '%s' or '%s'", s.Name, s.LogFormat, LogFormatText, LogFormatJson)
+		}
+		if s.Logs != nil && s.Logs.Dir == "" {
+			return fmt.Errorf("process '%s': logs require a 'dir'", s.Name)
+		}
+		for _, e := range s.EnvFrom {
+			switch {
+			case (e.File == "") == (e.ConfigMap == ""):
+				return fmt.Errorf("process '%s': envFrom entries require either a 'file' or a 'configMap'", s.Name)
+			case e.File != "":
+				if _, err := os.Stat(e.File); err != nil {
+					return fmt.Errorf("process '%s': envFrom: %w", s.Name, err)
+				}
+			default:
+				if e.configMap = configMaps[e.ConfigMap]; e.configMap == nil {
+					return fmt.Errorf("process '%s': envFrom: config map '%s' not found", s.Name, e.ConfigMap)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"rex-hive-daemon/hive_message"
+	"strings"
+	"time"
+)
+
+// Keys commonly used by logging libraries, in order of preference.
+var jsonLevelKeys = []string{"level", "lvl", "severity"}
+var jsonMessageKeys = []string{"msg", "message"}
+var jsonTimestampKeys = []string{"time", "ts", "timestamp", "@timestamp"}
+
+// setJsonLog parses the line as a JSON object into the message. Returns false, leaving the message untouched, if the
+// line is not a single JSON object.
+func setJsonLog(message *hive_message.HiveMessage, line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return false
+	}
+
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return false
+	}
+	// Decode stops after the first value, eg: a multiline group of JSON lines is kept as raw data
+	if _, err := decoder.Token(); err != io.EOF {
+		return false
+	}
+
+	if v, ok := popString(fields, jsonLevelKeys); ok {
+		message.Level = strings.ToLower(v)
+	}
+	if v, ok := popString(fields, jsonMessageKeys); ok {
+		message.Message = v
+	}
+	for _, k := range jsonTimestampKeys {
+		if t, ok := parseJsonTimestamp(fields[k]); ok {
+			message.Timestamp = &t
+			delete(fields, k)
+			break
+		}
+	}
+	if len(fields) > 0 {
+		message.Fields = fields
+	}
+	message.Data = ""
+	return true
+}
+
+// popString removes and returns the first of the keys holding a string.
+func popString(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, k := range keys {
+		if v, ok := fields[k].(string); ok {
+			delete(fields, k)
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseJsonTimestamp accepts RFC 3339 strings and unix epochs in seconds or milliseconds.
+func parseJsonTimestamp(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		return parsed, err == nil
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		// Epochs in milliseconds are way larger than any epoch in seconds
+		if f > 1e12 {
+			return time.UnixMilli(int64(f)), true
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
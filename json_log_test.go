@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"rex-hive-daemon/hive_message"
+	"testing"
+	"time"
+)
+
+func TestSetJsonLog(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+		want *hive_message.HiveMessage
+	}{
+		{"level, message, timestamp and fields", `{"level":"INFO","msg":"started","time":"2024-01-02T03:04:05Z","port":8080}`, true, &hive_message.HiveMessage{
+			Level:     "info",
+			Message:   "started",
+			Timestamp: &ts,
+			Fields:    map[string]interface{}{"port": json.Number("8080")},
+		}},
+		{"epoch in milliseconds", `  {"severity":"warn","message":"slow","ts":1704164645000}`, true, &hive_message.HiveMessage{
+			Level:     "warn",
+			Message:   "slow",
+			Timestamp: &ts,
+		}},
+		{"not an object", `[1, 2]`, false, nil},
+		{"plain text", `started on port 8080`, false, nil},
+		{"invalid JSON", `{"level": "info"`, false, nil},
+		{"multiline group of objects", "{\"msg\":\"first\"}\n{\"msg\":\"second\"}", false, nil},
+		{"trailing text", `{"msg":"first"} and more`, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := &hive_message.HiveMessage{Data: tt.line}
+			if ok := setJsonLog(message, tt.line); ok != tt.ok {
+				t.Fatalf("setJsonLog() = %v, want %v", ok, tt.ok)
+			}
+			want := tt.want
+			if !tt.ok {
+				// The raw line is kept untouched
+				want = &hive_message.HiveMessage{Data: tt.line}
+			}
+			if message.Timestamp != nil {
+				utc := message.Timestamp.UTC()
+				message.Timestamp = &utc
+			}
+			if !reflect.DeepEqual(message, want) {
+				t.Errorf("setJsonLog() message = %+v, want %+v", message, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package log_rotation
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is a log file rotated once it reaches a max size. Rotated files are renamed to `<path>.1`, `<path>.2`, ... with
+// `.1` being the most recent, optionally gzipped, and only the most recent maxFiles are kept.
+type File struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	compress bool
+	// Locks file and size, writes can come from the stdout and stderr of a process at the same time.
+	lock sync.Mutex
+	// file is nil once closed, or if reopening it failed while rotating, then the next write retries opening it.
+	file   *os.File
+	size   int64
+	closed bool
+	// compressing is closed once the rotated file being gzipped in the background is done, nil if there is none.
+	compressing chan bool
+	compressErr error
+}
+
+// Open opens, or creates, the log file at path and its parent directories. Writes are appended to an existing file.
+func Open(path string, maxSize int64, maxFiles int, compress bool) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f := &File{path: path, maxSize: maxSize, maxFiles: maxFiles, compress: compress}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		// The line is still written if the new file could be opened
+		if rotateErr = f.rotate(); f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Close closes the file, waiting for the last rotated file to be gzipped.
+func (f *File) Close() error {
+	f.lock.Lock()
+	var err error
+	f.closed = true
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	compressing := f.compressing
+	f.lock.Unlock()
+
+	if compressing != nil {
+		<-compressing
+	}
+	return err
+}
+
+// rotate closes the current file, shifts the rotated ones and opens a new empty file. The file is reopened even if
+// closing or shifting fails, so logging goes on. If reopening fails, the next write retries it.
+func (f *File) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+
+	// The previous rotated file must be gzipped before being shifted. Writes only wait for it if the file reached its
+	// max size again in the meantime.
+	if compressErr := f.waitCompression(); err == nil {
+		err = compressErr
+	}
+	if shiftErr := f.shift(); err == nil {
+		err = shiftErr
+	}
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// waitCompression waits for the rotated file being gzipped, if any, and returns the error gzipping it.
+func (f *File) waitCompression() error {
+	if f.compressing == nil {
+		return nil
+	}
+	<-f.compressing
+	f.compressing = nil
+	err := f.compressErr
+	f.compressErr = nil
+	return err
+}
+
+func (f *File) shift() error {
+	ext := ""
+	if f.compress {
+		ext = ".gz"
+	}
+
+	// Drop the oldest file and shift the rest, eg: `.2.gz` becomes `.3.gz`
+	_ = os.Remove(fmt.Sprintf("%s.%d%s", f.path, f.maxFiles, ext))
+	for n := f.maxFiles - 1; n >= 1; n-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d%s", f.path, n, ext), fmt.Sprintf("%s.%d%s", f.path, n+1, ext))
+	}
+
+	if f.maxFiles <= 0 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+	} else if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	} else if f.compress {
+		// Gzipped in the background, Write holds the lock and the output of the process would stall meanwhile
+		compressing := make(chan bool)
+		f.compressing = compressing
+		go func() {
+			defer close(compressing)
+			f.compressErr = gzipFile(f.path+".1", f.path+".1"+ext)
+		}()
+	}
+	return nil
+}
+
+// gzipFile compresses src into dst and removes src.
+func gzipFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,142 @@
+package log_rotation
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readDir returns the contents of the files in dir by name, gunzipping the .gz ones.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, e := range entries {
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if filepath.Ext(e.Name()) == ".gz" {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := io.ReadAll(r)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = string(b)
+	}
+	return files
+}
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFiles int
+		compress bool
+		existing string
+		writes   []string
+		want     map[string]string
+	}{
+		{"no rotation below the max size", 2, false, "", []string{"aaaa\n", "bbbb\n"}, map[string]string{
+			"app.log": "aaaa\nbbbb\n",
+		}},
+		{"rotated files are shifted and the oldest dropped", 2, false, "", []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"}, map[string]string{
+			"app.log":   "dddddddd\n",
+			"app.log.1": "cccccccc\n",
+			"app.log.2": "bbbbbbbb\n",
+		}},
+		{"rotated files are gzipped", 2, true, "", []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n"}, map[string]string{
+			"app.log":      "cccccccc\n",
+			"app.log.1.gz": "bbbbbbbb\n",
+			"app.log.2.gz": "aaaaaaaa\n",
+		}},
+		{"no rotated files are kept", 0, false, "", []string{"aaaaaaaa\n", "bbbbbbbb\n"}, map[string]string{
+			"app.log": "bbbbbbbb\n",
+		}},
+		{"existing file is appended and counts toward the max size", 2, false, "aaaa\n", []string{"bbbb\n", "cccc\n"}, map[string]string{
+			"app.log":   "cccc\n",
+			"app.log.1": "aaaa\nbbbb\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := Open(path, 10, tt.maxFiles, tt.compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readDir(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileReopensAfterFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "app.log")
+	f, err := Open(path, 10, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("aaaaaaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its directory, the file can't be rotated nor reopened
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bbbbbbbb\n")); err == nil {
+		t.Fatal("Write() without the directory succeeded")
+	}
+
+	// Once the directory is back, the next write opens the file again
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("cccccccc\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readDir(t, dir), map[string]string{"app.log": "cccccccc\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %q, want %q", got, want)
+	}
+}
+
+func TestFileClosed(t *testing.T) {
+	f, err := Open(filepath.Join(t.TempDir(), "app.log"), 10, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("a\n")); err != os.ErrClosed {
+		t.Errorf("Write() after Close() = %v, want %v", err, os.ErrClosed)
+	}
+}
@@ -0,0 +1,381 @@
+package machine_meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"rex-hive-daemon/rexprint"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	MetadataProviderAuto = "auto"
+	MetadataProviderNone = "none"
+)
+
+// Timeout shared by all the providers when detecting the provider, off-cloud the metadata address usually doesn't
+// answer at all.
+const detectTimeout = 500 * time.Millisecond
+
+// Timeout of a provider set explicitly.
+const providerTimeout = 3 * time.Second
+
+// Address of the metadata service of every supported provider.
+const metadataAddress = "http://169.254.169.254"
+
+// CloudMeta is the metadata of the cloud instance the daemon runs on, common to all providers.
+type CloudMeta struct {
+	Provider     string `bson:"provider"`               // eg: aws
+	InstanceId   string `bson:"instanceId,omitempty"`   // eg: i-02fc2df1209ccfdb1
+	InstanceType string `bson:"instanceType,omitempty"` // eg: t2.micro
+	Region       string `bson:"region,omitempty"`       // eg: us-east-1
+	Zone         string `bson:"zone,omitempty"`         // eg: us-east-1b
+	ImageId      string `bson:"imageId,omitempty"`      // eg: ami-04505e74c0741db8d
+	PrivateIp    string `bson:"privateIp,omitempty"`
+	PublicIp     string `bson:"publicIp,omitempty"`
+}
+
+// MetadataProvider gets the metadata of the instance from the metadata service of a cloud provider.
+type MetadataProvider interface {
+	Name() string
+	// Get returns the metadata of the instance, or an error if the daemon doesn't run on the provider.
+	Get(ctx context.Context, client *http.Client) (*CloudMeta, error)
+}
+
+// MetadataProviders returns all the supported providers, querying the metadata service at baseUrl, eg:
+// `http://169.254.169.254`.
+func MetadataProviders(baseUrl string) []MetadataProvider {
+	return []MetadataProvider{
+		&awsProvider{baseUrl: baseUrl},
+		&gcpProvider{baseUrl: baseUrl},
+		&azureProvider{baseUrl: baseUrl},
+		&digitalOceanProvider{baseUrl: baseUrl},
+		&hetznerProvider{baseUrl: baseUrl},
+	}
+}
+
+var (
+	metadataProvider = MetadataProviderAuto
+	// Locks reads and writes to metadataProvider.
+	metadataProviderLock sync.Mutex
+)
+
+// SetMetadataProvider sets the provider to get the metadata of the instance from: the name of a provider, eg: `aws`,
+// `auto` to detect it or `none` to skip it.
+func SetMetadataProvider(name string) error {
+	names := []string{MetadataProviderAuto, MetadataProviderNone}
+	for _, p := range MetadataProviders(metadataAddress) {
+		names = append(names, p.Name())
+	}
+	for _, n := range names {
+		if n == name {
+			metadataProviderLock.Lock()
+			metadataProvider = name
+			metadataProviderLock.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid metadata provider '%s', expected one of: %s", name, strings.Join(names, ", "))
+}
+
+// getCloudMeta gets the metadata of the instance from the configured provider.
+func getCloudMeta() (*CloudMeta, *AwsEc2IdentityDoc) {
+	metadataProviderLock.Lock()
+	name := metadataProvider
+	metadataProviderLock.Unlock()
+
+	if name == MetadataProviderNone {
+		return nil, nil
+	}
+	providers := MetadataProviders(metadataAddress)
+	timeout := detectTimeout
+	if name != MetadataProviderAuto {
+		for _, p := range providers {
+			if p.Name() == name {
+				providers = []MetadataProvider{p}
+			}
+		}
+		timeout = providerTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	meta, provider, err := DetectCloudMeta(ctx, &http.Client{}, providers)
+	if err != nil {
+		rexprint.Println(fmt.Sprintf("Cannot get the cloud metadata, might not be running on a cloud: %s", err.Error()))
+		return nil, nil
+	}
+	rexprint.Println(fmt.Sprintf("Running on %s, instance %s", meta.Provider, meta.InstanceId))
+	if aws, ok := provider.(*awsProvider); ok {
+		return meta, aws.identityDoc
+	}
+	return meta, nil
+}
+
+// DetectCloudMeta queries all the providers in parallel and returns the metadata of the first one that answers,
+// cancelling the others.
+func DetectCloudMeta(ctx context.Context, client *http.Client, providers []MetadataProvider) (*CloudMeta, MetadataProvider, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		meta     *CloudMeta
+		provider MetadataProvider
+		err      error
+	}
+	results := make(chan result, len(providers))
+	for _, p := range providers {
+		go func(p MetadataProvider) {
+			meta, err := p.Get(ctx, client)
+			results <- result{meta, p, err}
+		}(p)
+	}
+
+	var errs []string
+	for range providers {
+		r := <-results
+		if r.err == nil {
+			return r.meta, r.provider, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", r.provider.Name(), r.err.Error()))
+	}
+	return nil, nil, fmt.Errorf("no provider answered (%s)", strings.Join(errs, "; "))
+}
+
+// getMetadata sends a request to a metadata service and returns the body of a 200 response. When flavorHeader is set,
+// the response must have it, eg: GCP answers with `Metadata-Flavor: Google`.
+func getMetadata(ctx context.Context, client *http.Client, method string, url string, headers map[string]string, flavorHeader [2]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", res.StatusCode)
+	}
+	if flavorHeader[0] != "" && res.Header.Get(flavorHeader[0]) != flavorHeader[1] {
+		return nil, fmt.Errorf("missing header %s: %s", flavorHeader[0], flavorHeader[1])
+	}
+	return io.ReadAll(res.Body)
+}
+
+// lastSegment returns what follows the last slash, eg: the `e2-medium` of `projects/123/machineTypes/e2-medium`.
+func lastSegment(s string) string {
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+// awsProvider gets the instance identity document of EC2, with an IMDSv2 token when available.
+type awsProvider struct {
+	baseUrl     string
+	identityDoc *AwsEc2IdentityDoc
+}
+
+func (p *awsProvider) Name() string { return "aws" }
+
+func (p *awsProvider) Get(ctx context.Context, client *http.Client) (*CloudMeta, error) {
+	headers := map[string]string{}
+	token, err := getMetadata(ctx, client, http.MethodPut, p.baseUrl+"/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"}, [2]string{})
+	if err == nil {
+		headers["X-aws-ec2-metadata-token"] = string(token)
+	} else if ctx.Err() != nil {
+		return nil, err
+	}
+	// Without a token, IMDSv1 might still be enabled
+
+	b, err := getMetadata(ctx, client, http.MethodGet, p.baseUrl+"/latest/dynamic/instance-identity/document", headers, [2]string{})
+	if err != nil {
+		return nil, err
+	}
+	doc := &AwsEc2IdentityDoc{}
+	if err := json.Unmarshal(b, doc); err != nil || doc.InstanceId == "" {
+		return nil, fmt.Errorf("invalid instance identity document")
+	}
+	p.identityDoc = doc
+	return &CloudMeta{
+		Provider:     p.Name(),
+		InstanceId:   doc.InstanceId,
+		InstanceType: doc.InstanceType,
+		Region:       doc.Region,
+		Zone:         doc.AvailabilityZone,
+		ImageId:      doc.ImageId,
+		PrivateIp:    doc.PrivateIp,
+	}, nil
+}
+
+type gcpProvider struct {
+	baseUrl string
+}
+
+func (p *gcpProvider) Name() string { return "gcp" }
+
+func (p *gcpProvider) Get(ctx context.Context, client *http.Client) (*CloudMeta, error) {
+	b, err := getMetadata(ctx, client, http.MethodGet, p.baseUrl+"/computeMetadata/v1/instance/?recursive=true", map[string]string{"Metadata-Flavor": "Google"}, [2]string{"Metadata-Flavor", "Google"})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Id                json.Number `json:"id"`
+		MachineType       string      `json:"machineType"`
+		Zone              string      `json:"zone"`
+		Image             string      `json:"image"`
+		NetworkInterfaces []struct {
+			Ip            string `json:"ip"`
+			AccessConfigs []struct {
+				ExternalIp string `json:"externalIp"`
+			} `json:"accessConfigs"`
+		} `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	meta := &CloudMeta{
+		Provider:     p.Name(),
+		InstanceId:   doc.Id.String(),
+		InstanceType: lastSegment(doc.MachineType),
+		Zone:         lastSegment(doc.Zone),
+		ImageId:      lastSegment(doc.Image),
+	}
+	// Zones are the region plus a suffix, eg: us-central1-a
+	if i := strings.LastIndex(meta.Zone, "-"); i > 0 {
+		meta.Region = meta.Zone[:i]
+	}
+	if len(doc.NetworkInterfaces) > 0 {
+		meta.PrivateIp = doc.NetworkInterfaces[0].Ip
+		if len(doc.NetworkInterfaces[0].AccessConfigs) > 0 {
+			meta.PublicIp = doc.NetworkInterfaces[0].AccessConfigs[0].ExternalIp
+		}
+	}
+	return meta, nil
+}
+
+type azureProvider struct {
+	baseUrl string
+}
+
+func (p *azureProvider) Name() string { return "azure" }
+
+func (p *azureProvider) Get(ctx context.Context, client *http.Client) (*CloudMeta, error) {
+	b, err := getMetadata(ctx, client, http.MethodGet, p.baseUrl+"/metadata/instance?api-version=2021-02-01", map[string]string{"Metadata": "true"}, [2]string{})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Compute struct {
+			VmId     string `json:"vmId"`
+			VmSize   string `json:"vmSize"`
+			Location string `json:"location"`
+			Zone     string `json:"zone"`
+			Sku      string `json:"sku"`
+		} `json:"compute"`
+		Network struct {
+			Interface []struct {
+				Ipv4 struct {
+					IpAddress []struct {
+						PrivateIpAddress string `json:"privateIpAddress"`
+						PublicIpAddress  string `json:"publicIpAddress"`
+					} `json:"ipAddress"`
+				} `json:"ipv4"`
+			} `json:"interface"`
+		} `json:"network"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil || doc.Compute.VmId == "" {
+		return nil, fmt.Errorf("invalid instance metadata")
+	}
+	meta := &CloudMeta{
+		Provider:     p.Name(),
+		InstanceId:   doc.Compute.VmId,
+		InstanceType: doc.Compute.VmSize,
+		Region:       doc.Compute.Location,
+		Zone:         doc.Compute.Zone,
+		ImageId:      doc.Compute.Sku,
+	}
+	if len(doc.Network.Interface) > 0 && len(doc.Network.Interface[0].Ipv4.IpAddress) > 0 {
+		meta.PrivateIp = doc.Network.Interface[0].Ipv4.IpAddress[0].PrivateIpAddress
+		meta.PublicIp = doc.Network.Interface[0].Ipv4.IpAddress[0].PublicIpAddress
+	}
+	return meta, nil
+}
+
+type digitalOceanProvider struct {
+	baseUrl string
+}
+
+func (p *digitalOceanProvider) Name() string { return "digitalocean" }
+
+func (p *digitalOceanProvider) Get(ctx context.Context, client *http.Client) (*CloudMeta, error) {
+	b, err := getMetadata(ctx, client, http.MethodGet, p.baseUrl+"/metadata/v1.json", nil, [2]string{})
+	if err != nil {
+		return nil, err
+	}
+	type iface struct {
+		Ipv4 struct {
+			IpAddress string `json:"ip_address"`
+		} `json:"ipv4"`
+	}
+	var doc struct {
+		DropletId  json.Number `json:"droplet_id"`
+		Region     string      `json:"region"`
+		Interfaces struct {
+			Private []iface `json:"private"`
+			Public  []iface `json:"public"`
+		} `json:"interfaces"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil || doc.DropletId == "" {
+		return nil, fmt.Errorf("invalid droplet metadata")
+	}
+	meta := &CloudMeta{
+		Provider:   p.Name(),
+		InstanceId: doc.DropletId.String(),
+		Region:     doc.Region,
+	}
+	if len(doc.Interfaces.Private) > 0 {
+		meta.PrivateIp = doc.Interfaces.Private[0].Ipv4.IpAddress
+	}
+	if len(doc.Interfaces.Public) > 0 {
+		meta.PublicIp = doc.Interfaces.Public[0].Ipv4.IpAddress
+	}
+	return meta, nil
+}
+
+type hetznerProvider struct {
+	baseUrl string
+}
+
+func (p *hetznerProvider) Name() string { return "hetzner" }
+
+func (p *hetznerProvider) Get(ctx context.Context, client *http.Client) (*CloudMeta, error) {
+	b, err := getMetadata(ctx, client, http.MethodGet, p.baseUrl+"/hetzner/v1/metadata", nil, [2]string{})
+	if err != nil {
+		return nil, err
+	}
+	// The metadata is YAML
+	var doc struct {
+		InstanceId       json.Number `yaml:"instance-id"`
+		Region           string      `yaml:"region"`
+		AvailabilityZone string      `yaml:"availability-zone"`
+		PublicIpv4       string      `yaml:"public-ipv4"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil || doc.InstanceId == "" {
+		return nil, fmt.Errorf("invalid server metadata")
+	}
+	return &CloudMeta{
+		Provider:   p.Name(),
+		InstanceId: doc.InstanceId.String(),
+		Region:     doc.Region,
+		Zone:       doc.AvailabilityZone,
+		PublicIp:   doc.PublicIpv4,
+	}, nil
+}
@@ -0,0 +1,235 @@
+package machine_meta
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const awsTestToken = "AQAEAExampleToken=="
+
+// serveFixture answers with the contents of a file of testdata/cloud, only when the request has the given headers.
+func serveFixture(t *testing.T, name string, headers map[string]string, responseHeaders map[string]string) http.HandlerFunc {
+	b, err := os.ReadFile("testdata/cloud/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			if r.Header.Get(k) != v {
+				http.Error(w, "missing header "+k, http.StatusUnauthorized)
+				return
+			}
+		}
+		for k, v := range responseHeaders {
+			w.Header().Set(k, v)
+		}
+		_, _ = w.Write(b)
+	}
+}
+
+func awsToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte(awsTestToken))
+}
+
+// newMetadataServer stands in for the metadata service of a provider, serving only the given paths.
+func newMetadataServer(routes map[string]http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, h := range routes {
+		mux.HandleFunc(path, h)
+	}
+	return httptest.NewServer(mux)
+}
+
+func providerNamed(t *testing.T, baseUrl string, name string) MetadataProvider {
+	for _, p := range MetadataProviders(baseUrl) {
+		if p.Name() == name {
+			return p
+		}
+	}
+	t.Fatalf("no provider named %s", name)
+	return nil
+}
+
+func TestMetadataProviders(t *testing.T) {
+	awsMeta := &CloudMeta{
+		Provider:     "aws",
+		InstanceId:   "i-02fc2df1209ccfdb1",
+		InstanceType: "t2.micro",
+		Region:       "us-east-1",
+		Zone:         "us-east-1b",
+		ImageId:      "ami-04505e74c0741db8d",
+		PrivateIp:    "172.31.80.24",
+	}
+	tests := []struct {
+		name     string
+		provider string
+		routes   func(t *testing.T) map[string]http.HandlerFunc
+		want     *CloudMeta
+		wantErr  bool
+	}{
+		{"aws with an IMDSv2 token", "aws", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/latest/api/token":                          awsToken,
+				"/latest/dynamic/instance-identity/document": serveFixture(t, "aws-identity-document.json", map[string]string{"X-aws-ec2-metadata-token": awsTestToken}, nil),
+			}
+		}, awsMeta, false},
+		{"aws with IMDSv1 only", "aws", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/latest/dynamic/instance-identity/document": serveFixture(t, "aws-identity-document.json", nil, nil),
+			}
+		}, awsMeta, false},
+		{"gcp", "gcp", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/computeMetadata/v1/instance/": serveFixture(t, "gcp-instance.json", map[string]string{"Metadata-Flavor": "Google"}, map[string]string{"Metadata-Flavor": "Google"}),
+			}
+		}, &CloudMeta{
+			Provider:     "gcp",
+			InstanceId:   "4520031799277581759",
+			InstanceType: "e2-medium",
+			Region:       "us-central1",
+			Zone:         "us-central1-a",
+			ImageId:      "debian-11-bullseye-v20221102",
+			PrivateIp:    "10.128.0.5",
+			PublicIp:     "34.122.10.20",
+		}, false},
+		{"gcp without the flavor header in the response", "gcp", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/computeMetadata/v1/instance/": serveFixture(t, "gcp-instance.json", nil, nil),
+			}
+		}, nil, true},
+		{"azure", "azure", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/metadata/instance": serveFixture(t, "azure-instance.json", map[string]string{"Metadata": "true"}, nil),
+			}
+		}, &CloudMeta{
+			Provider:     "azure",
+			InstanceId:   "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			InstanceType: "Standard_D2s_v3",
+			Region:       "westeurope",
+			Zone:         "1",
+			ImageId:      "20_04-lts-gen2",
+			PrivateIp:    "10.0.0.4",
+			PublicIp:     "20.61.1.2",
+		}, false},
+		{"digitalocean", "digitalocean", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/metadata/v1.json": serveFixture(t, "digitalocean-metadata.json", nil, nil),
+			}
+		}, &CloudMeta{
+			Provider:   "digitalocean",
+			InstanceId: "2756294",
+			Region:     "nyc3",
+			PrivateIp:  "10.132.255.113",
+			PublicIp:   "104.131.20.105",
+		}, false},
+		{"hetzner", "hetzner", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/hetzner/v1/metadata": serveFixture(t, "hetzner-metadata.yaml", nil, nil),
+			}
+		}, &CloudMeta{
+			Provider:   "hetzner",
+			InstanceId: "42961236",
+			Region:     "eu-central",
+			Zone:       "fsn1-dc14",
+			PublicIp:   "116.203.10.20",
+		}, false},
+		{"invalid document", "digitalocean", func(t *testing.T) map[string]http.HandlerFunc {
+			return map[string]http.HandlerFunc{
+				"/metadata/v1.json": func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("<html>")) },
+			}
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMetadataServer(tt.routes(t))
+			defer server.Close()
+
+			got, err := providerNamed(t, server.URL, tt.provider).Get(context.Background(), server.Client())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectCloudMeta(t *testing.T) {
+	server := newMetadataServer(map[string]http.HandlerFunc{
+		"/metadata/instance": serveFixture(t, "azure-instance.json", map[string]string{"Metadata": "true"}, nil),
+	})
+	defer server.Close()
+
+	meta, provider, err := DetectCloudMeta(context.Background(), server.Client(), MetadataProviders(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Name() != "azure" || meta.Provider != "azure" || meta.InstanceId != "02aab8a4-74ef-476e-8182-f6d2ba4166a6" {
+		t.Errorf("DetectCloudMeta() = %+v from %s, want the azure instance", meta, provider.Name())
+	}
+}
+
+func TestDetectCloudMetaNoCloud(t *testing.T) {
+	// Answers 404 to everything
+	server := newMetadataServer(nil)
+	defer server.Close()
+
+	meta, provider, err := DetectCloudMeta(context.Background(), server.Client(), MetadataProviders(server.URL))
+	if err == nil {
+		t.Fatalf("DetectCloudMeta() = %+v from %v, want an error", meta, provider)
+	}
+	for _, p := range MetadataProviders(server.URL) {
+		if !strings.Contains(err.Error(), p.Name()+": ") {
+			t.Errorf("error %q doesn't report provider %s", err, p.Name())
+		}
+	}
+}
+
+func TestDetectCloudMetaSlowProvider(t *testing.T) {
+	// The aws endpoints never answer until the request is cancelled
+	slow := func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }
+	server := newMetadataServer(map[string]http.HandlerFunc{
+		"/latest/api/token":                          slow,
+		"/latest/dynamic/instance-identity/document": slow,
+		"/hetzner/v1/metadata":                       serveFixture(t, "hetzner-metadata.yaml", nil, nil),
+	})
+	defer server.Close()
+
+	// The fastest provider wins without waiting for the slow one
+	startedAt := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meta, _, err := DetectCloudMeta(ctx, server.Client(), MetadataProviders(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Provider != "hetzner" {
+		t.Errorf("DetectCloudMeta() provider = %s, want hetzner", meta.Provider)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+		t.Errorf("DetectCloudMeta() took %s, waited for the slow provider", elapsed)
+	}
+
+	// Only the slow provider is left, detection gives up at the timeout
+	startedAt = time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, err = DetectCloudMeta(ctx, server.Client(), []MetadataProvider{providerNamed(t, server.URL, "aws")})
+	if err == nil {
+		t.Fatal("DetectCloudMeta() of a provider that never answers succeeded")
+	}
+	if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+		t.Errorf("DetectCloudMeta() took %s, want it to give up at the 200ms timeout", elapsed)
+	}
+}
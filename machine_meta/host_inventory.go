@@ -0,0 +1,275 @@
+package machine_meta
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type CpuInfo struct {
+	Model   string `bson:"model,omitempty"` // eg: Intel(R) Xeon(R) CPU E5-2676 v3 @ 2.40GHz
+	Sockets int    `bson:"sockets"`
+	Cores   int    `bson:"cores"`   // Physical cores across all sockets
+	Threads int    `bson:"threads"` // Logical CPUs
+}
+
+type MemoryInfo struct {
+	TotalBytes     int64 `bson:"totalBytes"`
+	AvailableBytes int64 `bson:"availableBytes"`
+	SwapTotalBytes int64 `bson:"swapTotalBytes"`
+	SwapFreeBytes  int64 `bson:"swapFreeBytes"`
+}
+
+type DiskInfo struct {
+	Device         string `bson:"device"`     // eg: /dev/xvda1
+	MountPoint     string `bson:"mountPoint"` // eg: /
+	FsType         string `bson:"fsType"`     // eg: ext4
+	SizeBytes      int64  `bson:"sizeBytes"`
+	FreeBytes      int64  `bson:"freeBytes"`
+	AvailableBytes int64  `bson:"availableBytes"` // Free bytes available to unprivileged users
+}
+
+type LoadAverage struct {
+	Load1  float64 `bson:"load1"`
+	Load5  float64 `bson:"load5"`
+	Load15 float64 `bson:"load15"`
+}
+
+type NetworkInterface struct {
+	Name      string   `bson:"name"`          // eg: eth0
+	Mac       string   `bson:"mac,omitempty"` // eg: 0a:1b:2c:3d:4e:5f
+	Mtu       int      `bson:"mtu"`
+	Up        bool     `bson:"up"`
+	Addresses []string `bson:"addresses,omitempty"` // eg: 172.31.80.24/20
+}
+
+// readCpuInfo reads the CPU model and counts from `<procDir>/cpuinfo`.
+func readCpuInfo(procDir string) *CpuInfo {
+	f, err := os.Open(filepath.Join(procDir, "cpuinfo"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info := &CpuInfo{}
+	sockets := map[string]bool{}
+	cores := map[string]bool{}
+	physicalId := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "processor":
+			info.Threads++
+			physicalId = ""
+		case "model name", "Hardware", "Model":
+			// x86 has `model name`, some ARM kernels only `Hardware` or `Model`
+			if info.Model == "" {
+				info.Model = value
+			}
+		case "physical id":
+			physicalId = value
+			sockets[value] = true
+		case "core id":
+			cores[physicalId+"/"+value] = true
+		}
+	}
+
+	info.Sockets, info.Cores = len(sockets), len(cores)
+	// Not reported by every architecture
+	if info.Sockets <= 0 {
+		info.Sockets = 1
+	}
+	if info.Cores <= 0 {
+		info.Cores = info.Threads
+	}
+	return info
+}
+
+// readMemoryInfo reads the memory and swap sizes from `<procDir>/meminfo`.
+func readMemoryInfo(procDir string) *MemoryInfo {
+	f, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info := &MemoryInfo{}
+	fields := map[string]*int64{
+		"MemTotal":     &info.TotalBytes,
+		"MemAvailable": &info.AvailableBytes,
+		"SwapTotal":    &info.SwapTotalBytes,
+		"SwapFree":     &info.SwapFreeBytes,
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Eg: `MemTotal:        8029624 kB`
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		field, ok := fields[key]
+		if !found || !ok {
+			continue
+		}
+		parts := strings.Fields(value)
+		if len(parts) < 1 {
+			continue
+		}
+		n, _ := strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) > 1 && parts[1] == "kB" {
+			n *= 1024
+		}
+		*field = n
+	}
+	return info
+}
+
+// readLoadAverage reads the 1, 5 and 15 minutes load averages from `<procDir>/loadavg`.
+func readLoadAverage(procDir string) *LoadAverage {
+	b, err := os.ReadFile(filepath.Join(procDir, "loadavg"))
+	if err != nil {
+		return nil
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return nil
+	}
+	l := &LoadAverage{}
+	l.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	l.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	l.Load15, _ = strconv.ParseFloat(fields[2], 64)
+	return l
+}
+
+// readDisks reads the mounted filesystems backed by a device from `<procDir>/self/mounts`, along with the root
+// filesystem, which in containers is usually an overlay. Their sizes are filled by statfs.
+func readDisks(procDir string) []*DiskInfo {
+	// Filesystems flagged `nodev` in /proc/filesystems aren't backed by a device, eg: proc, tmpfs or cgroup2
+	virtual := map[string]bool{}
+	if b, err := os.ReadFile(filepath.Join(procDir, "filesystems")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "nodev" {
+				virtual[fields[1]] = true
+			}
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(procDir, "self", "mounts"))
+	if err != nil {
+		return nil
+	}
+	var disks []*DiskInfo
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(b), "\n") {
+		// Eg: `/dev/xvda1 / ext4 rw,relatime 0 0`
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		mountPoint := unescapeMountField(fields[1])
+		if seen[mountPoint] || (virtual[fields[2]] && mountPoint != "/") {
+			continue
+		}
+		seen[mountPoint] = true
+		d := &DiskInfo{Device: unescapeMountField(fields[0]), MountPoint: mountPoint, FsType: fields[2]}
+		statDisk(d)
+		disks = append(disks, d)
+	}
+	return disks
+}
+
+// unescapeMountField replaces the octal escapes of the fields of /proc/self/mounts, eg: `\040` for a space.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(field[i])
+	}
+	return sb.String()
+}
+
+// readNetworkInterfaces reads the network interfaces from `<sysDir>/class/net`. addresses returns the addresses of an
+// interface, they aren't in sysfs.
+func readNetworkInterfaces(sysDir string, addresses func(name string) []string) []*NetworkInterface {
+	netDir := filepath.Join(sysDir, "class", "net")
+	entries, err := os.ReadDir(netDir)
+	if err != nil {
+		return nil
+	}
+	var result []*NetworkInterface
+	for _, e := range entries {
+		dir := filepath.Join(netDir, e.Name())
+		n := &NetworkInterface{Name: e.Name(), Mac: readSysValue(dir, "address")}
+		// The loopback and tunnels have no hardware address
+		if strings.Trim(n.Mac, "0:") == "" {
+			n.Mac = ""
+		}
+		n.Mtu, _ = strconv.Atoi(readSysValue(dir, "mtu"))
+		// IFF_UP is the lowest bit of the flags, eg: 0x1003
+		flags, _ := strconv.ParseUint(strings.TrimPrefix(readSysValue(dir, "flags"), "0x"), 16, 32)
+		n.Up = flags&0x1 != 0
+		n.Addresses = addresses(e.Name())
+		result = append(result, n)
+	}
+	return result
+}
+
+func readSysValue(dir string, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// interfaceAddresses returns the addresses of the network interface with the given name, eg: 172.31.80.24/20.
+func interfaceAddresses(name string) []string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, a := range addrs {
+		result = append(result, a.String())
+	}
+	return result
+}
+
+// getNetworkInterfaces returns the network interfaces of the machine with their addresses.
+func getNetworkInterfaces() []*NetworkInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var result []*NetworkInterface
+	for _, iface := range ifaces {
+		n := &NetworkInterface{
+			Name: iface.Name,
+			Mac:  iface.HardwareAddr.String(),
+			Mtu:  iface.MTU,
+			Up:   iface.Flags&net.FlagUp != 0,
+		}
+		n.Addresses = interfaceAddresses(iface.Name)
+		result = append(result, n)
+	}
+	return result
+}
@@ -0,0 +1,14 @@
+package machine_meta
+
+import "syscall"
+
+// statDisk fills the size and free space of the disk.
+func statDisk(d *DiskInfo) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.MountPoint, &st); err != nil {
+		return
+	}
+	d.SizeBytes = int64(st.Blocks) * int64(st.Bsize)
+	d.FreeBytes = int64(st.Bfree) * int64(st.Bsize)
+	d.AvailableBytes = int64(st.Bavail) * int64(st.Bsize)
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package machine_meta
+
+// statDisk does nothing, disks are only read from /proc on linux.
+func statDisk(d *DiskInfo) {}
@@ -0,0 +1,139 @@
+package machine_meta
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadCpuInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		procDir string
+		want    *CpuInfo
+	}{
+		{"x86 with sockets and cores", "testdata/proc-x86", &CpuInfo{Model: "Intel(R) Xeon(R) CPU E5-2676 v3 @ 2.40GHz", Sockets: 1, Cores: 2, Threads: 4}},
+		{"arm without sockets nor cores", "testdata/proc-arm", &CpuInfo{Model: "BCM2835", Sockets: 1, Cores: 2, Threads: 2}},
+		{"missing file", "testdata/missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readCpuInfo(tt.procDir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readCpuInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMemoryInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		procDir string
+		want    *MemoryInfo
+	}{
+		{"all fields in kB", "testdata/proc-x86", &MemoryInfo{
+			TotalBytes:     8029624 * 1024,
+			AvailableBytes: 6291456 * 1024,
+			SwapTotalBytes: 2097152 * 1024,
+			SwapFreeBytes:  1048576 * 1024,
+		}},
+		{"missing fields are zero", "testdata/proc-arm", &MemoryInfo{TotalBytes: 3884328 * 1024}},
+		{"missing file", "testdata/missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readMemoryInfo(tt.procDir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readMemoryInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLoadAverage(t *testing.T) {
+	tests := []struct {
+		name    string
+		procDir string
+		want    *LoadAverage
+	}{
+		{"three averages", "testdata/proc-x86", &LoadAverage{Load1: 0.52, Load5: 0.58, Load15: 0.59}},
+		{"truncated file", "testdata/proc-arm", nil},
+		{"missing file", "testdata/missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readLoadAverage(tt.procDir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readLoadAverage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDisks(t *testing.T) {
+	tests := []struct {
+		name    string
+		procDir string
+		want    []DiskInfo
+	}{
+		{"virtual filesystems but the root are skipped", "testdata/proc-x86", []DiskInfo{
+			{Device: "overlay", MountPoint: "/", FsType: "overlay"},
+			{Device: "/dev/xvda1", MountPoint: "/data", FsType: "ext4"},
+			{Device: "/dev/xvdb1", MountPoint: "/mnt/game saves", FsType: "ext4"},
+			{Device: "/dev/nvme0n1p15", MountPoint: "/boot/efi", FsType: "vfat"},
+		}},
+		{"without the list of filesystems", "testdata/proc-arm", []DiskInfo{
+			{Device: "/dev/root", MountPoint: "/", FsType: "ext4"},
+		}},
+		{"missing file", "testdata/missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sizes come from statfs of the real mount points, only compare what's read from the fixtures
+			var got []DiskInfo
+			for _, d := range readDisks(tt.procDir) {
+				got = append(got, DiskInfo{Device: d.Device, MountPoint: d.MountPoint, FsType: d.FsType})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readDisks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/game\040saves`, "/mnt/game saves"},
+		{`/mnt/tab\011and\134backslash`, "/mnt/tab\tand\\backslash"},
+		{`/mnt/trailing\04`, `/mnt/trailing\04`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountField(tt.field); got != tt.want {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestReadNetworkInterfaces(t *testing.T) {
+	addresses := map[string][]string{
+		"eth0": {"172.31.80.24/20", "fe80::fc:ff:fe00:1/64"},
+		"lo":   {"127.0.0.1/8"},
+	}
+	got := readNetworkInterfaces("testdata/sys", func(name string) []string { return addresses[name] })
+	want := []*NetworkInterface{
+		{Name: "docker0", Mac: "02:42:ac:11:00:01", Mtu: 1500, Up: false},
+		{Name: "eth0", Mac: "02:fc:00:00:00:01", Mtu: 1400, Up: true, Addresses: addresses["eth0"]},
+		{Name: "lo", Mac: "", Mtu: 65536, Up: true, Addresses: addresses["lo"]},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, n := range got {
+			t.Logf("got %+v", *n)
+		}
+		t.Errorf("readNetworkInterfaces() differs from the fixture")
+	}
+
+	if got := readNetworkInterfaces("testdata/missing", func(string) []string { return nil }); got != nil {
+		t.Errorf("readNetworkInterfaces() of a missing dir = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,73 @@
+package machine_meta
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HostUsage is a sample of the resource usage of the whole machine.
+type HostUsage struct {
+	// CpuPercent is the busy time of all the CPUs since the previous sample, 100 when all of them are fully used.
+	CpuPercent  float64      `bson:"cpuPercent"`
+	Memory      *MemoryInfo  `bson:"memory,omitempty"`
+	LoadAverage *LoadAverage `bson:"loadAverage,omitempty"`
+	Disks       []*DiskInfo  `bson:"disks,omitempty"`
+}
+
+// HostSampler samples the resource usage of the machine, keeping the CPU times of the previous sample to compute the
+// CPU percent.
+type HostSampler struct {
+	procDir   string
+	lastTotal uint64
+	lastIdle  uint64
+}
+
+func NewHostSampler() *HostSampler {
+	s := &HostSampler{procDir: "/proc"}
+	s.lastTotal, s.lastIdle = readCpuTimes(s.procDir)
+	return s
+}
+
+// Sample reads the usage of the machine from /proc, so it's empty on systems other than linux.
+func (s *HostSampler) Sample() *HostUsage {
+	u := &HostUsage{
+		Memory:      readMemoryInfo(s.procDir),
+		LoadAverage: readLoadAverage(s.procDir),
+		Disks:       readDisks(s.procDir),
+	}
+	total, idle := readCpuTimes(s.procDir)
+	if total > s.lastTotal {
+		u.CpuPercent = float64((total-s.lastTotal)-(idle-s.lastIdle)) / float64(total-s.lastTotal) * 100
+	}
+	s.lastTotal, s.lastIdle = total, idle
+	return u
+}
+
+// readCpuTimes returns the total and idle times of all the CPUs from `<procDir>/stat`, in clock ticks.
+func readCpuTimes(procDir string) (total uint64, idle uint64) {
+	b, err := os.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return 0, 0
+	}
+	// Eg: `cpu  user nice system idle iowait irq softirq steal guest guest_nice`
+	line, _, _ := strings.Cut(string(b), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0
+	}
+	for i, f := range fields[1:] {
+		// Guest times are already included in user and nice
+		if i >= 8 {
+			break
+		}
+		n, _ := strconv.ParseUint(f, 10, 64)
+		total += n
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return total, idle
+}
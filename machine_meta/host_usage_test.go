@@ -0,0 +1,48 @@
+package machine_meta
+
+import (
+	"math"
+	"testing"
+)
+
+func TestReadCpuTimes(t *testing.T) {
+	tests := []struct {
+		name      string
+		procDir   string
+		wantTotal uint64
+		wantIdle  uint64
+	}{
+		{"idle and iowait are idle", "testdata/proc-x86", 10000, 8500},
+		{"guest times are not counted twice", "testdata/proc-x86-later", 11600, 9100},
+		{"no cpu line", "testdata/proc-arm", 0, 0},
+		{"missing file", "testdata/missing", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, idle := readCpuTimes(tt.procDir)
+			if total != tt.wantTotal || idle != tt.wantIdle {
+				t.Errorf("readCpuTimes() = %d, %d, want %d, %d", total, idle, tt.wantTotal, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestHostSamplerCpuPercent(t *testing.T) {
+	s := &HostSampler{procDir: "testdata/proc-x86"}
+	s.lastTotal, s.lastIdle = readCpuTimes(s.procDir)
+
+	// No time passed since the previous sample
+	if u := s.Sample(); u.CpuPercent != 0 {
+		t.Errorf("CpuPercent without new CPU time = %f, want 0", u.CpuPercent)
+	}
+
+	// 1600 ticks passed, 600 of them idle
+	s.procDir = "testdata/proc-x86-later"
+	u := s.Sample()
+	if math.Abs(u.CpuPercent-62.5) > 1e-9 {
+		t.Errorf("CpuPercent = %f, want 62.5", u.CpuPercent)
+	}
+	if u.Memory != nil || u.LoadAverage != nil {
+		t.Errorf("Sample() of a dir without meminfo nor loadavg = %+v, want no memory nor load average", u)
+	}
+}
@@ -1,15 +1,8 @@
 package machine_meta
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
 	"runtime"
-	"strings"
 	"time"
 )
 
@@ -21,78 +14,30 @@ func GetMachineMeta() *MachineMeta {
 	m.Goos = runtime.GOOS
 	m.Goarch = runtime.GOARCH
 
-	// Get LSB (Linux Standard Base) and Distribution information.
+	// Get the distribution, kernel, virtualization and host resources information.
 	if m.Goos == "linux" {
-		re := regexp.MustCompile(`(.+:\s*)`)
-		m.LsbRelease = &LsbRelease{}
-		if r, err := exec.Command("lsb_release", "--id").Output(); err == nil {
-			m.LsbRelease.Id = re.ReplaceAllString(strings.Trim(string(r), "\n"), "")
-		}
-		if r, err := exec.Command("lsb_release", "--description").Output(); err == nil {
-			m.LsbRelease.Description = re.ReplaceAllString(strings.Trim(string(r), "\n"), "")
-		}
-		if r, err := exec.Command("lsb_release", "--release").Output(); err == nil {
-			m.LsbRelease.Release = re.ReplaceAllString(strings.Trim(string(r), "\n"), "")
-		}
-		if r, err := exec.Command("lsb_release", "--codename").Output(); err == nil {
-			m.LsbRelease.Codename = re.ReplaceAllString(strings.Trim(string(r), "\n"), "")
-		}
-		m.Uname = &Uname{}
-		if r, err := exec.Command("uname", "--kernel-name").Output(); err == nil {
-			m.Uname.KernelName = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--nodename").Output(); err == nil {
-			m.Uname.NodeName = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--kernel-release").Output(); err == nil {
-			m.Uname.KernelRelease = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--kernel-version").Output(); err == nil {
-			m.Uname.KernelVersion = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--machine").Output(); err == nil {
-			m.Uname.Machine = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--processor").Output(); err == nil {
-			m.Uname.Processor = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--hardware-platform").Output(); err == nil {
-			m.Uname.HardwarePlatform = strings.Trim(string(r), "\n")
-		}
-		if r, err := exec.Command("uname", "--operating-system").Output(); err == nil {
-			m.Uname.OperatingSystem = strings.Trim(string(r), "\n")
-		}
+		m.LsbRelease = readOsRelease("/")
+		m.Uname = getUname()
+		m.Virtualization = detectVirtualization("/", os.Getenv)
+		m.Cpu = readCpuInfo("/proc")
+		m.Memory = readMemoryInfo("/proc")
+		m.Disks = readDisks("/proc")
+		m.LoadAverage = readLoadAverage("/proc")
+		m.NetworkInterfaces = readNetworkInterfaces("/sys", interfaceAddresses)
 	}
-	m.AwsEc2Meta = getAwsMeta()
-	return m
-}
-
-func getAwsMeta() *AwsEc2IdentityDoc {
-	c := http.Client{}
-	c.Timeout = time.Second * 2
-	res, err := c.Get("http://169.254.169.254/latest/dynamic/instance-identity/document") // Constant URL
-	if err != nil {
-		fmt.Println("Cannot call AWS EC2 info endpoint, might not be running on AWS.")
-		return nil
-	}
-
-	if res.StatusCode != 200 {
-		fmt.Println(fmt.Sprintf("Called call AWS EC2 info endpoint but received status code %d", res.StatusCode))
-		return nil
+	if m.NetworkInterfaces == nil {
+		m.NetworkInterfaces = getNetworkInterfaces()
 	}
-
-	b, _ := io.ReadAll(res.Body)
-
-	doc := &AwsEc2IdentityDoc{}
-	_ = json.Unmarshal(b, doc)
-	return doc
+	m.Cloud, m.AwsEc2Meta = getCloudMeta()
+	return m
 }
 
+// LsbRelease keeps the fields of lsb_release, read from the os-release file.
 type LsbRelease struct {
-	Id          string `bson:"id,omitempty"`          // eg: Distributor ID: Ubuntu
-	Description string `bson:"description,omitempty"` // eg: Description:    Ubuntu 20.04.5 LTS
-	Release     string `bson:"release,omitempty"`     // eg: Release:        20.04
-	Codename    string `bson:"codename,omitempty"`    // eg: Codename:       focal
+	Id          string `bson:"id,omitempty"`          // NAME, eg: Ubuntu
+	Description string `bson:"description,omitempty"` // PRETTY_NAME, eg: Ubuntu 20.04.5 LTS
+	Release     string `bson:"release,omitempty"`     // VERSION_ID, eg: 20.04
+	Codename    string `bson:"codename,omitempty"`    // VERSION_CODENAME, eg: focal
 }
 type Uname struct {
 	KernelName       string `bson:"kernelName,omitempty"`       // eg: Linux
@@ -102,20 +47,28 @@ type Uname struct {
 	Machine          string `bson:"machine,omitempty"`          // eg: x86_64
 	Processor        string `bson:"processor,omitempty"`        // eg: x86_64
 	HardwarePlatform string `bson:"hardwarePlatform,omitempty"` // eg: x86_64
-	OperatingSystem  string `bson:"operatingSystem,omitempty"`  // eg: GNU/Linux
+	OperatingSystem  string `bson:"operatingSystem,omitempty"`  // eg: GNU/Linux, empty if the C library is unknown
 }
 
 type MachineMeta struct {
-	Hostname   string             `bson:"hostname,omitempty"` // eg: ip-172-31-80-24
-	Goos       string             `bson:"goos,omitempty"`     // eg: linux
-	Goarch     string             `bson:"goarch,omitempty"`   // eg: amd64
-	LsbRelease *LsbRelease        `bson:"lsbRelease,omitempty"`
-	Uname      *Uname             `bson:"uname,omitempty"`
-	AwsEc2Meta *AwsEc2IdentityDoc `bson:"awsEc2Meta,omitempty"`
+	Hostname   string      `bson:"hostname,omitempty"` // eg: ip-172-31-80-24
+	Goos       string      `bson:"goos,omitempty"`     // eg: linux
+	Goarch     string      `bson:"goarch,omitempty"`   // eg: amd64
+	LsbRelease *LsbRelease `bson:"lsbRelease,omitempty"`
+	Uname      *Uname      `bson:"uname,omitempty"`
+	// Container runtime and hypervisor, detected on linux
+	Virtualization *Virtualization    `bson:"virtualization,omitempty"`
+	AwsEc2Meta     *AwsEc2IdentityDoc `bson:"awsEc2Meta,omitempty"`
+	// Cloud is the metadata of the instance, whichever the provider. AwsEc2Meta is also set on AWS.
+	Cloud *CloudMeta `bson:"cloud,omitempty"`
+	// Host resources, read from /proc on linux
+	Cpu               *CpuInfo            `bson:"cpu,omitempty"`
+	Memory            *MemoryInfo         `bson:"memory,omitempty"`
+	Disks             []*DiskInfo         `bson:"disks,omitempty"`
+	LoadAverage       *LoadAverage        `bson:"loadAverage,omitempty"`
+	NetworkInterfaces []*NetworkInterface `bson:"networkInterfaces,omitempty"`
 }
 
-// TODO: Get amount of ram, cpu and storage
-
 type AwsEc2IdentityDoc struct {
 	AccountId               string      `json:"accountId" bson:"accountId,omitempty"`
 	Architecture            string      `json:"architecture" bson:"architecture,omitempty"`
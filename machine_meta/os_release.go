@@ -0,0 +1,52 @@
+package machine_meta
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readOsRelease reads the distribution information from `<root>/etc/os-release`, or `<root>/usr/lib/os-release` as
+// systemd documents, mapped to the fields of lsb_release. Returns nil when neither exists.
+func readOsRelease(root string) *LsbRelease {
+	var f *os.File
+	var err error
+	for _, p := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if f, err = os.Open(filepath.Join(root, p)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Eg: `PRETTY_NAME="Ubuntu 20.04.5 LTS"`
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		values[key] = value
+	}
+
+	return &LsbRelease{
+		Id:          values["NAME"],
+		Description: values["PRETTY_NAME"],
+		Release:     values["VERSION_ID"],
+		Codename:    values["VERSION_CODENAME"],
+	}
+}
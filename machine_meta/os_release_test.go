@@ -0,0 +1,39 @@
+package machine_meta
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadOsRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		want *LsbRelease
+	}{
+		{"double quotes, comments and blank lines", "testdata/os-release/ubuntu", &LsbRelease{
+			Id:          "Ubuntu",
+			Description: "Ubuntu 20.04.5 LTS",
+			Release:     "20.04",
+			Codename:    "focal",
+		}},
+		{"single quotes, escapes and usr/lib fallback", "testdata/os-release/fedora-usr-lib", &LsbRelease{
+			Id:          "Fedora Linux",
+			Description: `Fedora Linux 38 ("Workstation Edition")`,
+			Release:     "38",
+		}},
+		{"unquoted and unbalanced quotes", "testdata/os-release/unquoted", &LsbRelease{
+			Id:          "Alpine Linux",
+			Description: "Alpine Linux v3.18",
+			Release:     "3.18.4",
+		}},
+		{"missing file", "testdata/missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readOsRelease(tt.root); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readOsRelease() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package machine_meta
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// getUname returns the same information as the `uname` command.
+func getUname() *Uname {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		return nil
+	}
+	machine := utsString(u.Machine[:])
+	return &Uname{
+		KernelName:    utsString(u.Sysname[:]),
+		NodeName:      utsString(u.Nodename[:]),
+		KernelRelease: utsString(u.Release[:]),
+		KernelVersion: utsString(u.Version[:]),
+		Machine:       machine,
+		// Not reported by the kernel, `uname` prints the machine on most distributions
+		Processor:        machine,
+		HardwarePlatform: machine,
+		OperatingSystem:  operatingSystem("/"),
+	}
+}
+
+// operatingSystem tells the operating system as `uname -o` does from the C library of the machine under root, whose
+// dynamic loader is found in `<root>/lib*`: GNU/Linux with glibc and Linux with musl, eg: Alpine. Empty if neither is
+// found, eg: a static binary in a scratch container.
+func operatingSystem(root string) string {
+	for _, libc := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"GNU/Linux", []string{"lib*/ld-linux*.so.*", "lib*/ld64.so.*"}},
+		{"Linux", []string{"lib/ld-musl-*.so.1"}},
+	} {
+		for _, pattern := range libc.patterns {
+			if matches, _ := filepath.Glob(filepath.Join(root, pattern)); len(matches) > 0 {
+				return libc.name
+			}
+		}
+	}
+	return ""
+}
+
+// utsString converts a null terminated field of Utsname, whose type is []int8 or []uint8 depending on the architecture.
+func utsString[T int8 | uint8](field []T) string {
+	b := make([]byte, 0, len(field))
+	for _, c := range field {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
@@ -0,0 +1,60 @@
+package machine_meta
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUtsString(t *testing.T) {
+	if got := utsString([]int8{'x', '8', '6', '_', '6', '4', 0, 'j', 'u', 'n', 'k'}); got != "x86_64" {
+		t.Errorf("utsString([]int8) = %q, want %q", got, "x86_64")
+	}
+	if got := utsString([]uint8{'a', 'a', 'r', 'c', 'h', '6', '4'}); got != "aarch64" {
+		t.Errorf("utsString([]uint8) without null terminator = %q, want %q", got, "aarch64")
+	}
+	if got := utsString([]uint8{0, 'x'}); got != "" {
+		t.Errorf("utsString() of an empty field = %q, want empty", got)
+	}
+}
+
+func TestGetUname(t *testing.T) {
+	u := getUname()
+	if u == nil {
+		t.Fatal("getUname() = nil")
+	}
+	if u.KernelName != "Linux" || u.KernelRelease == "" || u.Machine == "" {
+		t.Errorf("getUname() = %+v", u)
+	}
+}
+
+func TestOperatingSystem(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"glibc on x86_64", []string{"lib64/ld-linux-x86-64.so.2"}, "GNU/Linux"},
+		{"glibc on arm64", []string{"lib/ld-linux-aarch64.so.1"}, "GNU/Linux"},
+		{"glibc on s390x", []string{"lib/ld64.so.1"}, "GNU/Linux"},
+		{"musl", []string{"lib/ld-musl-x86_64.so.1"}, "Linux"},
+		{"no loader", []string{"bin/busybox"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, name := range tt.files {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, nil, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := operatingSystem(root); got != tt.want {
+				t.Errorf("operatingSystem() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package machine_meta
+
+// getUname returns nil, uname is only read on linux.
+func getUname() *Uname {
+	return nil
+}
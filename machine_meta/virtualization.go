@@ -0,0 +1,80 @@
+package machine_meta
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Virtualization struct {
+	Container  string `bson:"container,omitempty"`  // eg: docker, podman, systemd-nspawn
+	Kubernetes bool   `bson:"kubernetes,omitempty"` // Running in a kubernetes pod
+	Hypervisor string `bson:"hypervisor,omitempty"` // eg: kvm, qemu, xen, vmware, hyper-v
+}
+
+// Values of /sys/class/dmi/id/sys_vendor and product_name, lowercased, by hypervisor.
+var dmiHypervisors = []struct {
+	match      string
+	hypervisor string
+}{
+	{"kvm", "kvm"},
+	{"qemu", "qemu"},
+	{"amazon ec2", "kvm"}, // Nitro
+	{"google compute engine", "kvm"},
+	{"xen", "xen"},
+	{"vmware", "vmware"},
+	{"virtualbox", "virtualbox"},
+	{"microsoft corporation", "hyper-v"},
+	{"bochs", "bochs"},
+}
+
+// detectVirtualization detects the container runtime and hypervisor the daemon runs in, reading the files of the
+// filesystem at root, normally `/`, and the env of the daemon.
+func detectVirtualization(root string, getenv func(string) string) *Virtualization {
+	v := &Virtualization{}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(root, p))
+		return err == nil
+	}
+	read := func(p string) string {
+		b, _ := os.ReadFile(filepath.Join(root, p))
+		return strings.ToLower(strings.TrimSpace(string(b)))
+	}
+
+	// systemd sets `container` in the env of PID 1 and in /run/systemd/container, eg: podman and systemd-nspawn
+	container := getenv("container")
+	if container == "" {
+		container = read("run/systemd/container")
+	}
+	switch {
+	case container != "":
+		v.Container = container
+	case exists("run/.containerenv"):
+		v.Container = "podman"
+	case exists(".dockerenv"):
+		v.Container = "docker"
+	default:
+		// cgroup v1 paths include the runtime, eg: `12:pids:/docker/<id>`
+		cgroup := read("proc/1/cgroup")
+		for _, name := range []string{"docker", "containerd", "crio", "libpod", "lxc"} {
+			if strings.Contains(cgroup, "/"+name) {
+				v.Container = strings.Replace(name, "libpod", "podman", 1)
+				break
+			}
+		}
+	}
+	v.Kubernetes = getenv("KUBERNETES_SERVICE_HOST") != "" || exists("var/run/secrets/kubernetes.io/serviceaccount")
+
+	dmi := read("sys/class/dmi/id/sys_vendor") + " " + read("sys/class/dmi/id/product_name")
+	for _, h := range dmiHypervisors {
+		if strings.Contains(dmi, h.match) {
+			v.Hypervisor = h.hypervisor
+			break
+		}
+	}
+	// The CPU flags report a hypervisor even without DMI, eg: in a container on a VM
+	if v.Hypervisor == "" && strings.Contains(read("proc/cpuinfo"), " hypervisor") {
+		v.Hypervisor = "unknown"
+	}
+	return v
+}
@@ -0,0 +1,36 @@
+package machine_meta
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectVirtualization(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		env  map[string]string
+		want *Virtualization
+	}{
+		{"bare metal", "testdata/missing", nil, &Virtualization{}},
+		{"container env var", "testdata/missing", map[string]string{"container": "podman"}, &Virtualization{Container: "podman"}},
+		{"systemd container file", "testdata/virt/nspawn", nil, &Virtualization{Container: "systemd-nspawn"}},
+		{"containerenv file", "testdata/virt/podman", nil, &Virtualization{Container: "podman"}},
+		{"dockerenv file", "testdata/virt/docker", nil, &Virtualization{Container: "docker"}},
+		{"docker cgroup", "testdata/virt/docker-cgroup", nil, &Virtualization{Container: "docker"}},
+		{"libpod cgroup", "testdata/virt/libpod-cgroup", nil, &Virtualization{Container: "podman"}},
+		{"kubernetes service account", "testdata/virt/kubernetes", nil, &Virtualization{Kubernetes: true}},
+		{"kubernetes env var", "testdata/missing", map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1"}, &Virtualization{Kubernetes: true}},
+		{"ec2 dmi", "testdata/virt/ec2", nil, &Virtualization{Hypervisor: "kvm"}},
+		{"vmware dmi", "testdata/virt/vmware", nil, &Virtualization{Hypervisor: "vmware"}},
+		{"hypervisor cpu flag", "testdata/virt/cpu-flag", nil, &Virtualization{Hypervisor: "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectVirtualization(tt.root, func(key string) string { return tt.env[key] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("detectVirtualization() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
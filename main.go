@@ -1,17 +1,27 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"rex-hive-daemon/backoff"
+	"rex-hive-daemon/control_api"
+	"rex-hive-daemon/cpu_affinity"
 	"rex-hive-daemon/hive_message"
 	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/log_rotation"
+	"rex-hive-daemon/machine_meta"
 	"rex-hive-daemon/message_handler"
+	"rex-hive-daemon/otlp_export"
+	"rex-hive-daemon/prometheus_metrics"
+	"rex-hive-daemon/replica_registry"
+	"rex-hive-daemon/resource_limits"
+	"rex-hive-daemon/rexpty"
 	"rex-hive-daemon/slice_tools"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,20 +38,20 @@ var (
 func killAllProcesses() {
 	killingLock.Lock()
 	tearingDown = true
-	fmt.Println("Trying to kill", len(runningCommands), "processes")
+	p.Println("Trying to kill", len(runningCommands), "processes")
 	for _, cmd := range runningCommands {
 		if cmd == nil || cmd.Process == nil {
-			fmt.Println("Command", cmd, "has a nil process, cannot be stopped or it's already stopped")
+			p.Println("Command", cmd, "has a nil process, cannot be stopped or it's already stopped")
 			continue
 		}
 		if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
-			fmt.Println("Could not send SIGINT signal to process. Error:", err, "PID:", cmd.Process.Pid, cmd, "will try to kill it...")
+			p.Println("Could not send SIGINT signal to process. Error:", err, "PID:", cmd.Process.Pid, cmd, "will try to kill it...")
 			if err = cmd.Process.Kill(); err != nil {
-				fmt.Println("Could not kill process. Error:", err, "PID:", cmd.Process.Pid, cmd)
+				p.Println("Could not kill process. Error:", err, "PID:", cmd.Process.Pid, cmd)
 				continue
 			}
 		}
-		fmt.Println("process successfully killed", cmd.Process.Pid, cmd)
+		p.Println("process successfully killed", cmd.Process.Pid, cmd)
 	}
 	killingLock.Unlock()
 }
@@ -51,92 +61,119 @@ func listenForTermination() {
 	signal.Notify(sigsChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigsChan
-		fmt.Println("Just received a signal:", sig, "will wait to flush before exiting")
+		p.Println("Just received a signal:", sig, "will wait to flush before exiting")
 		killAllProcesses()
 	}()
 }
 
 // Eg. Run with: `go run .\main.go --file=./demo-specs/test-spec.yml`
 func main() {
+	// `attach <index>` is a client of a running daemon, not a daemon itself
+	if len(os.Args) > 1 && os.Args[1] == "attach" {
+		os.Exit(attach(os.Args[2:]))
+	}
+	// The shim that sets the rlimits of a replica before executing it
+	if len(os.Args) > 1 && os.Args[1] == resource_limits.ShimCommand {
+		os.Exit(resource_limits.RunShim(os.Args[2:]))
+	}
+
 	listenForTermination()
 
 	// Define cli params
 	filePathPtr := flag.String("file", "", "spec file containing args")
+	dryRunPtr := flag.Bool("dry-run", false, "print the expanded command line and env of every replica without running them")
+	logFormatPtr := flag.String("log-format", p.FormatText, "format of the daemon's output: text or json")
+	colorPtr := flag.String("color", p.ColorAuto, "color the daemon's text output: auto, always or never")
+	prefixPtr := flag.String("prefix", p.DefaultPrefix, "prefix of the text lines about a replica, placeholders: {time} {name} {index} {pid} {attempt} {stream}")
+	metadataProviderPtr := flag.String("metadata-provider", machine_meta.MetadataProviderAuto, "cloud to get the instance metadata from: auto, none, aws, gcp, azure, digitalocean or hetzner")
+	metricsAddrPtr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on at /metrics, eg: :9100, empty to disable it")
+	controlSocketPtr := flag.String("control-socket", control_api.DefaultSocketPath(), "unix socket for the control API, empty to disable it")
 	flag.Parse()
 
+	if err := p.Configure(*logFormatPtr, *colorPtr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	p.SetPrefix(*prefixPtr)
+	if err := machine_meta.SetMetadataProvider(*metadataProviderPtr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := otlp_export.Configure(os.Getenv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	// Read and parse file
 	hiveSpec, err := hive_spec.FromFile(*filePathPtr)
 	if err != nil {
 		panic(err)
 	}
 
-	if os.Getenv("USE_MONGO") == "1" {
-		go message_handler.Run(hiveSpec)
+	// Allocate dynamic args of all the replicas before running anything
+	plans, err := planHiveSpec(hiveSpec)
+	if err != nil {
+		p.Println(p.ErrColor(err.Error()))
+		os.Exit(1)
 	}
 
-	runHiveSpec(hiveSpec)
+	if *dryRunPtr {
+		printDryRun(plans)
+		return
+	}
 
-	if os.Getenv("USE_MONGO") == "1" {
-		// Wait for messages to be stored in DB (flushing)
-		fmt.Println(p.Dim("HiveRun finished, waiting to flush"))
-		flushChan := make(chan bool)
-		message_handler.Flush(&flushChan)
-		<-flushChan
-		close(flushChan)
+	if *controlSocketPtr != "" {
+		go control_api.Run(*controlSocketPtr)
 	}
+
+	if *metricsAddrPtr != "" {
+		go prometheus_metrics.Run(*metricsAddrPtr)
+	}
+
+	processNames := make([]string, len(plans))
+	for _, plan := range plans {
+		processNames[plan.index] = plan.spec.Name
+	}
+	if err := message_handler.Start(hiveSpec, func(index int) string { return processNames[index] }); err != nil {
+		p.Println(p.ErrColor(err.Error()))
+		os.Exit(1)
+	}
+
+	runHiveSpec(hiveSpec, plans)
+
+	// Wait for messages to be written to the sinks (flushing)
+	message_handler.Flush()
 }
 
-func runHiveSpec(hiveSpec *hive_spec.HiveSpec) {
+func runHiveSpec(hiveSpec *hive_spec.HiveSpec, plans []*replicaPlan) {
 
 	if len((*hiveSpec).Spec.Processes) < 1 {
-		fmt.Println("No process specs to run")
+		p.Println("No process specs to run")
 		return
 	}
 
-	var usedNumsInSequence = map[int]bool{}
-	count := 0
-
-	// Before running any process, validate that we can get all the dynamic args
-	for _, s := range hiveSpec.Spec.Processes {
-		for rep := 0; rep < s.Replicas; rep++ {
-			// This line will panic if we cannot get all the dynamic args
-			args := s.Cmd[1:]
-			getDynamicArgsOrPanic(&args, &usedNumsInSequence)
-			count++
-		}
-	}
-	usedNumsInSequence = map[int]bool{} // Reset map of used nums after validation
-	fmt.Println(fmt.Sprintf("Process specs: %d, total processes: %d", len((*hiveSpec).Spec.Processes), count))
-	count = 0 // Also reset count
-	// End of validations
+	p.Println(fmt.Sprintf("Process specs: %d, total processes: %d", len((*hiveSpec).Spec.Processes), len(plans)))
 
 	hiveChan := make(chan *hive_message.HiveMessage)
 
 	go func() {
 		// Spawn processes in spec
 		var wg sync.WaitGroup
-		colors := p.GetRandomColors()
-		for _, processSpec := range hiveSpec.Spec.Processes {
-			for rep := 0; rep < processSpec.Replicas; rep++ {
-				wg.Add(1)
-				args := processSpec.Cmd[1:]
-				replacedArgs := getDynamicArgsOrPanic(&args, &usedNumsInSequence)
-				go runCommandAndKeepAlive(&hiveChan, count, &wg, colors, processSpec, replacedArgs...)
-				count++
-			}
+		for _, plan := range plans {
+			wg.Add(1)
+			go runCommandAndKeepAlive(&hiveChan, plan, &wg)
 		}
 		wg.Wait()
 		close(hiveChan)
 	}()
 
 	for c := range hiveChan {
-		if os.Getenv("USE_MONGO") == "1" {
-			message_handler.OnHiveMessage(c)
-		}
+		message_handler.OnHiveMessage(c)
 	}
 }
 
-func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, i int, group *sync.WaitGroup, colors []int, processSpec *hive_spec.ProcessSpec, args ...string) {
+func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, plan *replicaPlan, group *sync.WaitGroup) {
+	i, processSpec := plan.index, plan.spec
 	restartPolicy := stringToRestartPolicy[processSpec.Restart]
 
 	// Sync with wait group
@@ -145,7 +182,14 @@ func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, i int, gro
 	// Validate retry policy
 	if restartPolicy != Always && restartPolicy != OnFailure && restartPolicy != Never {
 		panic(fmt.Sprintf("Invalid retry policy %d", restartPolicy))
-		return
+	}
+
+	// Unless a log file is written per attempt, all the attempts share the same log file
+	var logFile *log_rotation.File
+	if processSpec.Logs != nil && !processSpec.Logs.PerAttempt {
+		if logFile = openReplicaLog(processSpec, i, -1); logFile != nil {
+			defer logFile.Close()
+		}
 	}
 
 	runCount := -1
@@ -155,11 +199,11 @@ func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, i int, gro
 		startedAt := time.Now()
 
 		// If the command never stops, the following line will block until command execution terminates
-		id, exitCode := runCommand(hiveChan, i, runCount, colors, processSpec, args...)
+		source, exitCode := runCommand(hiveChan, plan, runCount, logFile)
 
 		killingLock.Lock()
 		if tearingDown {
-			p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("tearing down, wont re-run ANY process")))
+			p.PrintLnColor(source, p.Dim(fmt.Sprintf("tearing down, wont re-run ANY process")))
 			killingLock.Unlock()
 			return
 		}
@@ -176,27 +220,31 @@ func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, i int, gro
 		}
 
 		// If this line is reached, the command exited, either successfully of with an error
-		p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("runtime: %s", elapsed)))
+		p.PrintLnColor(source, p.Dim(fmt.Sprintf("runtime: %s", elapsed)))
 		switch restartPolicy {
 		case Never:
 			{
-				p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("won't re-run")))
+				p.PrintLnColor(source, p.Dim(fmt.Sprintf("won't re-run")))
 				return
 			}
 		case Always:
 			{
 				delay := backoff.ExpBackoffSeconds(backoffCount)
-				p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("will re-run after %s", delay)))
+				p.PrintLnColor(source, p.Dim(fmt.Sprintf("will re-run after %s", delay)))
+				prometheus_metrics.ReplicaBackoff(i, processSpec.Name, delay)
+				otlp_export.Backoff(i, delay)
 				time.Sleep(delay)
 			}
 		case OnFailure:
 			{
 				if exitCode == 0 {
-					p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("won't re-run")))
+					p.PrintLnColor(source, p.Dim(fmt.Sprintf("won't re-run")))
 					return
 				} else {
 					delay := backoff.ExpBackoffSeconds(backoffCount)
-					p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("will re-run after %s", delay)))
+					p.PrintLnColor(source, p.Dim(fmt.Sprintf("will re-run after %s", delay)))
+					prometheus_metrics.ReplicaBackoff(i, processSpec.Name, delay)
+					otlp_export.Backoff(i, delay)
 					time.Sleep(delay)
 				}
 			}
@@ -207,18 +255,42 @@ func runCommandAndKeepAlive(hiveChan *chan *hive_message.HiveMessage, i int, gro
 const invalidPid = -1
 const noExitCode = -1
 
-func runCommand(hiveChan *chan *hive_message.HiveMessage, i int, attempt int, colors []int, processSpec *hive_spec.ProcessSpec, args ...string) (name string, pid int) {
-	preSpawnId := fmt.Sprintf("%d:%d:%d", i, invalidPid, attempt)
+// Max time to keep reading the output of a process once it exited, its descendants may keep the output open.
+const outputDrainTimeout = 2 * time.Second
+
+func openPty(processSpec *hive_spec.ProcessSpec) (master *os.File, slave *os.File, err error) {
+	columns, rows := hive_spec.DefaultTtyColumns, hive_spec.DefaultTtyRows
+	if o := processSpec.TtyOptions; o != nil {
+		if o.Columns > 0 {
+			columns = o.Columns
+		}
+		if o.Rows > 0 {
+			rows = o.Rows
+		}
+	}
+	return rexpty.Open(columns, rows)
+}
+
+func runCommand(hiveChan *chan *hive_message.HiveMessage, plan *replicaPlan, attempt int, logFile *log_rotation.File) (source p.Source, exitCode int) {
+	i, processSpec, args := plan.index, plan.spec, plan.args
+	preSpawnSource := p.Source{Name: processSpec.Name, Index: i, Pid: invalidPid, Attempt: attempt}
+
+	// Opened before taking the lock, the files of previous attempts are pruned meanwhile
+	if processSpec.Logs != nil && processSpec.Logs.PerAttempt {
+		if logFile = openReplicaLog(processSpec, i, attempt); logFile != nil {
+			defer logFile.Close()
+		}
+	}
 
 	killingLock.Lock()
 	if tearingDown {
-		p.PrintLnColor(preSpawnId, colors, i, p.Dim(fmt.Sprintf("tearing down, skipping process")))
+		p.PrintLnColor(preSpawnSource, p.Dim(fmt.Sprintf("tearing down, skipping process")))
 		killingLock.Unlock()
-		return preSpawnId, invalidPid
+		return preSpawnSource, invalidPid
 	}
 
 	// Execute command
-	cmd := exec.Command(processSpec.Cmd[0], args...)
+	cmd := exec.Command(processSpec.Cmd[0].Value, args...)
 	runningCommands = append(runningCommands, cmd)
 	killingLock.Unlock()
 
@@ -233,31 +305,109 @@ func runCommand(hiveChan *chan *hive_message.HiveMessage, i int, attempt int, co
 		killingLock.Unlock()
 	}()
 
-	// Get command out pipes
-	stdout, err := cmd.StdoutPipe()
-	stderr, err := cmd.StderrPipe()
+	cmdSummary := fmt.Sprintf("'%s', args: %s, restart: %s", processSpec.Cmd[0].Value, plan.displayArgs(), processSpec.Restart)
 
-	cmdSummary := fmt.Sprintf("'%s', args: %s, restart: %s", processSpec.Cmd[0], args, processSpec.Restart)
-
-	func() {
+	// Set up env. Precedence, from lowest to highest: forwarded OS env vars, envFrom sources, env entries of the spec.
+	redactor := plan.redactor
+	err := func() error {
 		if len(processSpec.Env) <= 0 {
-			p.PrintLnColor(preSpawnId, colors, i, p.Dim("process spec has no env vars"))
+			p.PrintLnColor(preSpawnSource, p.Dim("process spec has no env vars"))
 		}
 
-		if processSpec.ForwardOsEnv {
-			cmd.Env = os.Environ()
-			fmt.Println(cmd.Env)
+		env := newProcessEnv(func(msg string) { p.PrintLnColor(preSpawnSource, p.Dim(msg)) })
+		env.forwardOsEnv(os.Environ(), &processSpec.ForwardOsEnv)
+		sensitive, err := env.envFrom(processSpec.EnvFrom)
+		if err != nil {
+			return err
 		}
-
-		for _, envEntry := range processSpec.Env {
-			p.PrintLnColor(preSpawnId, colors, i, p.Dim(fmt.Sprintf("setting env %s=%s", envEntry.Name, envEntry.Value)))
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envEntry.Name, envEntry.Value))
+		if len(sensitive) > 0 {
+			redactor = redactor.With(sensitive)
 		}
+		for j, envEntry := range processSpec.Env {
+			p.PrintLnColor(preSpawnSource, p.Dim(fmt.Sprintf("setting env %s=%s", envEntry.Name, plan.displayEnvValue(j))))
+			env.set(envEntry.Name, envEntry.Value, "spec", envEntry.Sensitive)
+		}
+		cmd.Env = env.environ()
+		return nil
 	}()
 
-	// Start command
-	if err = cmd.Start(); err != nil {
-		p.PrintLnColor(preSpawnId, colors, i, p.ErrColor(fmt.Sprintf("cannot start %s: %s", cmdSummary, err.Error())))
+	// Set up stdin
+	var stdin io.WriteCloser
+	var stdinSource io.Reader
+	if err == nil && processSpec.Stdin != nil {
+		switch {
+		case processSpec.Stdin.Interactive:
+			if !processSpec.Tty {
+				stdin, err = cmd.StdinPipe()
+			}
+		case processSpec.Stdin.File != "":
+			var f *os.File
+			if f, err = os.Open(processSpec.Stdin.File); err == nil {
+				stdinSource = f
+				defer f.Close()
+			}
+		default:
+			stdinSource = strings.NewReader(processSpec.Stdin.Text)
+		}
+	}
+
+	// Set up output, either through pipes or a pseudo-terminal. The daemon keeps the read ends, the child gets its own
+	// copy of the write ends, or of the slave.
+	var stdout, stderr, ptyMaster *os.File
+	var childOutput []*os.File
+	if err == nil {
+		if processSpec.Tty {
+			var ptySlave *os.File
+			if ptyMaster, ptySlave, err = openPty(processSpec); err == nil {
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = ptySlave, ptySlave, ptySlave
+				cmd.SysProcAttr = rexpty.SysProcAttr()
+				childOutput = append(childOutput, ptySlave)
+				defer ptyMaster.Close()
+				if processSpec.Stdin != nil && processSpec.Stdin.Interactive {
+					stdin = ptyMaster
+				}
+			}
+		} else {
+			if stdinSource != nil {
+				// An interactive stdin is already set up by StdinPipe
+				cmd.Stdin = stdinSource
+			}
+			// Own pipes instead of StdoutPipe, Wait would close them before the output of descendants is drained
+			var stdoutWriter, stderrWriter *os.File
+			if stdout, stdoutWriter, err = os.Pipe(); err == nil {
+				defer stdout.Close()
+				childOutput = append(childOutput, stdoutWriter)
+				if stderr, stderrWriter, err = os.Pipe(); err == nil {
+					defer stderr.Close()
+					childOutput = append(childOutput, stderrWriter)
+				}
+			}
+			cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
+		}
+	}
+
+	cmd.Dir = processSpec.WorkingDir
+	applyCredential(cmd, plan.credential)
+
+	// Start command, within its resource limits from the start
+	var resources *resource_limits.Applied
+	if err == nil {
+		resources = prepareResources(preSpawnSource, processSpec, i, attempt)
+		start := cmd.Start
+		if len(plan.cpus) > 0 {
+			start = func() error { return cpu_affinity.Start(cmd, plan.cpus) }
+		}
+		err = resources.Start(cmd, start)
+	}
+	for _, f := range childOutput {
+		// The child has its own copy, the end of the output is only reported once all copies are closed
+		_ = f.Close()
+	}
+	if err != nil {
+		resources.Release()
+		p.PrintLnColor(preSpawnSource, p.ErrColor(fmt.Sprintf("cannot start %s: %s", cmdSummary, err.Error())))
+		writeReplicaLog(logFile, string(hive_message.ProcessAborted), invalidPid, attempt, err.Error())
+		prometheus_metrics.ReplicaExited(i, processSpec.Name, noExitCode)
 		*hiveChan <- &hive_message.HiveMessage{
 			Index:    i,
 			Pid:      invalidPid,
@@ -266,63 +416,116 @@ func runCommand(hiveChan *chan *hive_message.HiveMessage, i int, attempt int, co
 			Data:     err.Error(),
 			ExitCode: noExitCode,
 		}
-		return preSpawnId, invalidPid
+		return preSpawnSource, invalidPid
 	}
 
 	// At this point we've got a PID for the process
+	startedAt := time.Now()
 
 	// ID format: index:PID:attempt where attempt increases by one each time the command is restarted
-	id := fmt.Sprintf("%d:%d:%d", i, cmd.Process.Pid, attempt)
-
-	// TODO: Beware of printing all args, since the user might pass sensitive data as env vars for the game.
-	p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("running %s, PID %d", cmdSummary, cmd.Process.Pid)))
+	source = p.Source{Name: processSpec.Name, Index: i, Pid: cmd.Process.Pid, Attempt: attempt}
+
+	// Make the replica reachable from the control API while it runs
+	replica := replica_registry.Register(i, processSpec.Name, cmd.Process.Pid, attempt, stdin)
+	defer replica_registry.Unregister(replica)
+	prometheus_metrics.ReplicaStarted(i, processSpec.Name, cmd.Process.Pid, attempt)
+	replica_registry.Publish(i, replica_registry.Output{Stream: "started", Pid: cmd.Process.Pid, Attempt: attempt})
+	writeReplicaLog(logFile, string(hive_message.ProcessStarted), cmd.Process.Pid, attempt, cmdSummary)
+
+	p.PrintLnColor(source, p.Dim(fmt.Sprintf("running %s, PID %d", cmdSummary, cmd.Process.Pid)))
+	if len(plan.cpus) > 0 {
+		p.PrintLnColor(source, p.Dim(fmt.Sprintf("pinned to CPUs %s", cpu_affinity.FormatList(plan.cpus))))
+	}
 
 	*hiveChan <- &hive_message.HiveMessage{
-		Index:    i,
-		Pid:      cmd.Process.Pid,
-		Attempt:  attempt,
-		Type:     hive_message.ProcessStarted,
-		Data:     "",
-		ExitCode: noExitCode,
+		Index:       i,
+		Pid:         cmd.Process.Pid,
+		Attempt:     attempt,
+		Type:        hive_message.ProcessStarted,
+		Data:        "",
+		ExitCode:    noExitCode,
+		CpuAffinity: plan.cpus,
 	}
 
-	// Print realtime stdout from command
+	a := &runAttempt{
+		hiveChan:    hiveChan,
+		index:       i,
+		pid:         cmd.Process.Pid,
+		attempt:     attempt,
+		source:      source,
+		redactor:    redactor,
+		processSpec: processSpec,
+		logFile:     logFile,
+	}
+	a.reportResources(resources)
+	// The sampler must be stopped before returning, the channel of messages is closed once all replicas return
+	metricsDone, metricsStopped := make(chan bool), make(chan bool)
 	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			m := scanner.Text()
-			p.PrintLnColor(id, colors, i, p.OutColor("STDOUT"), m)
-			*hiveChan <- &hive_message.HiveMessage{
-				Index:    i,
-				Pid:      cmd.Process.Pid,
-				Attempt:  attempt,
-				Type:     hive_message.ProcessStdOut,
-				Data:     m,
-				ExitCode: noExitCode,
-			}
-		}
+		a.sampleMetrics(metricsDone)
+		close(metricsStopped)
 	}()
 
-	// Print realtime stderr from command
-	go func() {
-		scannerErr := bufio.NewScanner(stderr)
-		for scannerErr.Scan() {
-			m := scannerErr.Text()
-			p.PrintLnColor(id, colors, i, p.ErrColor("STDERR"), m)
-			*hiveChan <- &hive_message.HiveMessage{
-				Index:    i,
-				Pid:      cmd.Process.Pid,
-				Attempt:  attempt,
-				Type:     hive_message.ProcessStdErr,
-				Data:     m,
-				ExitCode: noExitCode,
-			}
+	// Print realtime output from command
+	outputDone := make(chan bool)
+	if ptyMaster != nil {
+		if stdinSource != nil {
+			go func() { _, _ = io.Copy(ptyMaster, stdinSource) }()
 		}
-	}()
+		go func() {
+			var transform func(string) string
+			if processSpec.TtyOptions == nil || !processSpec.TtyOptions.KeepAnsi {
+				transform = rexpty.StripAnsi
+			}
+			// Terminal lines end with "\r\n"
+			a.captureOutput(ptyMaster, hive_message.ProcessStdOut, func(m string) string {
+				m = strings.TrimSuffix(m, "\r")
+				if transform != nil {
+					m = transform(m)
+				}
+				return m
+			})
+			close(outputDone)
+		}()
+	} else {
+		var captured sync.WaitGroup
+		captured.Add(2)
+		go func() {
+			a.captureOutput(stdout, hive_message.ProcessStdOut, nil)
+			captured.Done()
+		}()
+		go func() {
+			a.captureOutput(stderr, hive_message.ProcessStdErr, nil)
+			captured.Done()
+		}()
+		go func() {
+			captured.Wait()
+			close(outputDone)
+		}()
+	}
 
 	// Wait for command to complete
-	if err := cmd.Wait(); err != nil {
-		p.PrintLnColor(id, colors, i, p.ErrColor(fmt.Sprintf("%s. Error-exited with code (%d)", cmdSummary, cmd.ProcessState.ExitCode())), err.Error())
+	err = cmd.Wait()
+	exit := exitInfoOf(cmd.ProcessState, time.Since(startedAt))
+	close(metricsDone)
+	<-metricsStopped
+	// The end of the output is only reported once the child and all its descendants close it. Don't wait forever for
+	// descendants that outlive the child, closing the read ends makes the capture stop.
+	select {
+	case <-outputDone:
+	case <-time.After(outputDrainTimeout):
+		for _, f := range []*os.File{ptyMaster, stdout, stderr} {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+		<-outputDone
+	}
+	a.releaseResources(resources)
+	prometheus_metrics.ReplicaExited(i, processSpec.Name, cmd.ProcessState.ExitCode())
+	replica_registry.Publish(i, replica_registry.Output{Stream: "exited", Pid: cmd.Process.Pid, Attempt: attempt, Data: fmt.Sprintf("exit code %d", cmd.ProcessState.ExitCode())})
+	writeReplicaLog(logFile, string(hive_message.ProcessExited), cmd.Process.Pid, attempt, fmt.Sprintf("exit code %d", cmd.ProcessState.ExitCode()))
+	if err != nil {
+		p.PrintLnColor(source, p.ErrColor(fmt.Sprintf("%s. Error-exited with code (%d)", cmdSummary, cmd.ProcessState.ExitCode())), err.Error())
 		*hiveChan <- &hive_message.HiveMessage{
 			Index:    i,
 			Pid:      cmd.Process.Pid,
@@ -330,10 +533,11 @@ func runCommand(hiveChan *chan *hive_message.HiveMessage, i int, attempt int, co
 			Type:     hive_message.ProcessExited,
 			Data:     err.Error(),
 			ExitCode: cmd.ProcessState.ExitCode(),
+			Exit:     exit,
 		}
-		return id, cmd.ProcessState.ExitCode()
+		return source, cmd.ProcessState.ExitCode()
 	} else {
-		p.PrintLnColor(id, colors, i, p.Dim(fmt.Sprintf("%s. Success-exited with code (%d)", cmdSummary, cmd.ProcessState.ExitCode())))
+		p.PrintLnColor(source, p.Dim(fmt.Sprintf("%s. Success-exited with code (%d)", cmdSummary, cmd.ProcessState.ExitCode())))
 		*hiveChan <- &hive_message.HiveMessage{
 			Index:    i,
 			Pid:      cmd.Process.Pid,
@@ -341,7 +545,8 @@ func runCommand(hiveChan *chan *hive_message.HiveMessage, i int, attempt int, co
 			Type:     hive_message.ProcessExited,
 			Data:     "",
 			ExitCode: 0, // 0 = success
+			Exit:     exit,
 		}
-		return id, 0
+		return source, 0
 	}
 }
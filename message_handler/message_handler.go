@@ -1,232 +1,239 @@
 package message_handler
 
 import (
-	"context"
-	"errors"
 	"fmt"
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"os"
 	"rex-hive-daemon/hive_message"
 	"rex-hive-daemon/hive_spec"
-	"rex-hive-daemon/machine_meta"
+	"rex-hive-daemon/otlp_export"
+	"rex-hive-daemon/prometheus_metrics"
 	"rex-hive-daemon/rexprint"
-	"rex-hive-daemon/slice_tools"
 	"sync"
 	"time"
 )
 
-const storeToDatabaseEverySeconds = 1
-const maxMessagesToStorePerRequest = 200
-const databaseTimeoutSeconds = 5
-const mongoDatabaseName = "rex-hive"
-const mongoCollectionHiveMessage = "message"
-const mongoCollectionHiveRun = "run"
+// Sink is a destination of the messages of a run, eg: a database. Every sink gets every message.
+type Sink interface {
+	Name() string
+	// Open is called once with the spec of the run, before writing any message.
+	Open(hiveSpec *hive_spec.HiveSpec) error
+	// Write sends a batch of messages. On error, the whole batch is written again later.
+	Write(batch []*hive_message.HiveMessage) error
+	// Flush sends the messages buffered by the sink itself, if any. On error, they stay buffered and are flushed again
+	// later.
+	Flush() error
+	Close() error
+}
+
+const maxFlushGraceSeconds = 5
+
+// sinkRunner buffers the messages of a sink and writes them in batches, independently of the other sinks.
+type sinkRunner struct {
+	sink   Sink
+	spec   *hive_spec.SinkSpec
+	opened chan bool
+	buffer []*hive_message.HiveMessage
+	// Amount of messages ever removed from the start of buffer, either written or dropped.
+	removed int
+	// Amount of messages dropped since the last write because the buffer was full.
+	dropped int
+	// Locks reads and writes to buffer, removed and dropped.
+	lock sync.Mutex
+	// Locks writing, so batches are written in order.
+	writeLock sync.Mutex
+}
 
 var (
-	holdingMessages []*hive_message.HiveMessage
-	writingMessages []string
-	lockForHolding  sync.Mutex
-	lockForWriting  sync.Mutex
-	didStartup      = false
-	machineMeta     = &machine_meta.MachineMeta{}
-	// Channels helps to block execution while there are still pending messages to store in DB
-	flushChan        *chan bool
-	hiveRunId        interface{}
-	flushRequestTime time.Time
+	runners []*sinkRunner
+	// Locks reads and writes to runners.
+	runnersLock sync.Mutex
 )
 
-const maxFlushGraceSeconds = 5
-
-func Run(hiveSpec *hive_spec.HiveSpec) {
-	if didStartup {
-		return
+// Start opens the sinks of the spec, or the default sinks when the spec has none: mongo when USE_MONGO=1 and otlp
+// when an OTLP endpoint is set. processName returns the name of the process of a replica index.
+func Start(hiveSpec *hive_spec.HiveSpec, processName func(index int) string) error {
+	specs := hiveSpec.Spec.Sinks
+	if len(specs) <= 0 {
+		if os.Getenv("USE_MONGO") == "1" {
+			specs = append(specs, &hive_spec.SinkSpec{Type: hive_spec.SinkMongo})
+		}
+		if otlp_export.Enabled() {
+			specs = append(specs, &hive_spec.SinkSpec{Type: hive_spec.SinkOtlp})
+		}
 	}
-	didStartup = true
 
-	// Get machine metadata
-	machineMeta = machine_meta.GetMachineMeta()
-	hiveSpec.RuntimeMachine = machineMeta
-	hiveSpec.Id = genHiveRunId()
-	hiveSpec.Time = time.Now()
-	insertResult, err := insertOne(mongoCollectionHiveRun, hiveSpec)
-	if err != nil {
-		fmt.Println("cannot insert hive run in mongodb", rexprint.ErrColor(err.Error()))
-	} else {
-		hiveRunId = insertResult.InsertedID
-		fmt.Println(rexprint.OutColor(fmt.Sprintf("hive run inserted with ID %s", hiveRunId)))
+	var started []*sinkRunner
+	for _, spec := range specs {
+		spec.SetDefaults()
+		var sink Sink
+		switch spec.Type {
+		case hive_spec.SinkMongo:
+			sink = &mongoSink{heartbeatInterval: spec.HeartbeatInterval}
+		case hive_spec.SinkOtlp:
+			if !otlp_export.Enabled() {
+				return fmt.Errorf("the otlp sink requires an OTLP endpoint, eg: OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318")
+			}
+			sink = &otlpSink{processName: processName}
+		default:
+			return fmt.Errorf("invalid sink type '%s'", spec.Type)
+		}
+		started = append(started, &sinkRunner{sink: sink, spec: spec, opened: make(chan bool)})
 	}
 
-	for {
-		time.Sleep(storeToDatabaseEverySeconds * time.Second)
-		hearBeat()
+	runnersLock.Lock()
+	runners = started
+	runnersLock.Unlock()
+	for _, r := range started {
+		go r.run(hiveSpec)
 	}
+	return nil
 }
 
-func Flush(c *chan bool) {
-	flushChan = c
-	flushRequestTime = time.Now()
-}
-
-func hearBeat() {
-	bulkStoreMessagesInMongo()
+// OnHiveMessage hands the message to every sink.
+func OnHiveMessage(message *hive_message.HiveMessage) {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+	if len(runners) <= 0 {
+		return
+	}
+	message.Id = primitive.NewObjectID()
+	message.Time = time.Now()
+	for _, r := range runners {
+		r.add(message)
+	}
 }
 
-func connectDb() (*mongo.Client, error) {
-	// Get connection string
-	if err := godotenv.Load(); err != nil {
-		return nil, errors.New("no .env file found")
+// Flush writes the buffered messages of every sink and closes them. It blocks until all the messages are written, or
+// until maxFlushGraceSeconds pass for the sinks that keep failing.
+func Flush() {
+	runnersLock.Lock()
+	toFlush := runners
+	runners = nil
+	runnersLock.Unlock()
+	if len(toFlush) <= 0 {
+		return
 	}
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, errors.New("You must set your 'MONGODB_URI' environmental variable. See\n\t https://www.mongodb.com/docs/drivers/go/current/usage-examples/#environment-variable")
+	rexprint.Println(rexprint.Dim("HiveRun finished, waiting to flush"))
+
+	var wg sync.WaitGroup
+	for _, r := range toFlush {
+		wg.Add(1)
+		go func(r *sinkRunner) {
+			defer wg.Done()
+			r.flush(time.Now().Add(maxFlushGraceSeconds * time.Second))
+		}(r)
 	}
-
-	// Connect to database
-	t := databaseTimeoutSeconds * time.Second
-	opts := options.Client().ApplyURI(uri).SetTimeout(t).SetConnectTimeout(t).SetSocketTimeout(t).SetServerSelectionTimeout(t)
-	return mongo.Connect(context.TODO(), opts)
+	wg.Wait()
 }
 
-func min(a int, b int) int {
-	if a < b {
-		return a
+func (r *sinkRunner) add(message *hive_message.HiveMessage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// Drop the oldest messages rather than growing without bounds while the sink is failing
+	if len(r.buffer) >= r.spec.MaxBuffered {
+		r.buffer = r.buffer[1:]
+		r.removed++
+		r.dropped++
 	}
-	return b
+	r.buffer = append(r.buffer, message)
+	prometheus_metrics.SetHoldingMessages(r.sink.Name(), len(r.buffer))
 }
 
-func insertOne(collection string, document interface{}) (*mongo.InsertOneResult, error) {
-	// Get DB connection
-	client, err := connectDb()
-	if err != nil {
-		return nil, err
+func (r *sinkRunner) run(hiveSpec *hive_spec.HiveSpec) {
+	if err := r.sink.Open(hiveSpec); err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot open sink %s: %s", r.sink.Name(), err)))
 	}
+	close(r.opened)
 
-	// Disconnect from DB on exit
-	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			fmt.Println(rexprint.ErrColor(err.Error()))
-		}
-	}()
-
-	// Get DB collection
-	coll := client.Database(mongoDatabaseName).Collection(collection)
-	return coll.InsertOne(context.TODO(), document)
+	for {
+		time.Sleep(r.spec.Interval)
+		_, _ = r.write()
+	}
 }
 
-func insertMany(collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
-	// Get DB connection
-	client, err := connectDb()
-	if err != nil {
-		return nil, err
+// write writes a batch of the buffered messages and flushes the sink. Returns the amount of messages left.
+func (r *sinkRunner) write() (int, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	r.lock.Lock()
+	batch := r.buffer[:min(len(r.buffer), r.spec.BatchSize)]
+	removedBefore := r.removed
+	dropped := r.dropped
+	r.dropped = 0
+	r.lock.Unlock()
+
+	if dropped > 0 {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("sink %s is full, dropped %d messages", r.sink.Name(), dropped)))
 	}
+	// Sinks that buffer messages themselves only send them on flush, failing to flush is failing to write
+	startedAt := time.Now()
+	if len(batch) > 0 {
+		if err := r.sink.Write(batch); err != nil {
+			prometheus_metrics.ObserveFlush(r.sink.Name(), time.Since(startedAt), err)
+			rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot write %d messages to sink %s: %s", len(batch), r.sink.Name(), err)))
+			return r.length(), err
+		}
 
-	// Disconnect from DB on exit
-	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			fmt.Println(rexprint.ErrColor(err.Error()))
+		// The oldest messages of the batch may have been dropped while writing, only remove the rest
+		r.lock.Lock()
+		if left := len(batch) - (r.removed - removedBefore); left > 0 {
+			r.buffer = r.buffer[left:]
+			r.removed += left
 		}
-	}()
+		prometheus_metrics.SetHoldingMessages(r.sink.Name(), len(r.buffer))
+		r.lock.Unlock()
+	}
+
+	err := r.sink.Flush()
+	if len(batch) > 0 || err != nil {
+		prometheus_metrics.ObserveFlush(r.sink.Name(), time.Since(startedAt), err)
+	}
+	if err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot flush sink %s: %s", r.sink.Name(), err)))
+		return r.length(), err
+	}
+	return r.length(), nil
+}
 
-	// Get DB collection
-	coll := client.Database(mongoDatabaseName).Collection(collection)
-	return coll.InsertMany(context.TODO(), documents)
+func (r *sinkRunner) length() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.buffer)
 }
 
-func bulkStoreMessagesInMongo() {
-	// If no holding messages, there's nothing to store
-	if len(holdingMessages) <= 0 {
-		fmt.Println(rexprint.Dim("Holding zero messages, skipping save"))
-		if flushChan != nil {
-			*flushChan <- true
-			flushChan = nil
-		}
+// flush writes all the buffered messages, retrying failed batches until the deadline, and closes the sink.
+func (r *sinkRunner) flush(deadline time.Time) {
+	select {
+	case <-r.opened:
+	case <-time.After(time.Until(deadline)):
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("sink %s: still opening, %d messages won't be written", r.sink.Name(), r.length())))
 		return
 	}
 
-	// Get array of message IDs to store. Using mutex lock to make it goroutine-safe.
-	lockForWriting.Lock()
-	lockForHolding.Lock() // Lock the 'holding' map to quickly get messages to write
-	holdingMessagesLength := len(holdingMessages)
-	toWriteLength := min(holdingMessagesLength, maxMessagesToStorePerRequest)
-	fmt.Println(rexprint.Dim(fmt.Sprintf("Will store %d messages. Holding: %d, Max: %d", toWriteLength, holdingMessagesLength, maxMessagesToStorePerRequest)))
-	writingMessages = make([]string, toWriteLength)
-	docs := make([]interface{}, toWriteLength) // Prepare data to write into MongoDB
-	for i, v := range holdingMessages {
-		writingMessages[i] = v.TempId
-		// Add machine meta right before sending it to DB
-		v.RuntimeMachine = machineMeta
-		v.HiveRunId = hiveRunId
-		docs[i] = v
-		i++
-		if i >= toWriteLength {
+	for {
+		left, err := r.write()
+		if left <= 0 && err == nil {
+			rexprint.Println(rexprint.Dim(fmt.Sprintf("sink %s: all messages written, flush complete", r.sink.Name())))
 			break
 		}
-	}
-
-	// IMPORTANT: Unlock the 'holding' map before trying to write to DB since that op could take a few seconds.
-	lockForHolding.Unlock()
-
-	// Insert data in MongoDB
-	_, err := insertMany(mongoCollectionHiveMessage, docs)
-
-	if err != nil {
-		// Reset the writing array, even if data fails to be stored in DB
-		fmt.Println(rexprint.ErrColor(fmt.Sprintf("Error sotring %d messages. Held before: %d, hold now: %d. Error: %s", toWriteLength, holdingMessagesLength, len(holdingMessages), err)))
-		writingMessages = []string{}
-		lockForWriting.Unlock() // Unlock writing array even if DB storing fails
-	} else {
-		// Remove the stored messages from temp holding map. Using its own mutex to manipulate the map.
-		lockForHolding.Lock()
-
-		for _, k := range writingMessages {
-			holdingMessages = *slice_tools.RemoveFirst(&holdingMessages, func(x *hive_message.HiveMessage) bool { return x.TempId == k })
+		if time.Now().After(deadline) {
+			rexprint.Println(rexprint.ErrColor(fmt.Sprintf("sink %s: timeout reached, %d messages won't be written", r.sink.Name(), left)))
+			break
 		}
-		fmt.Println(rexprint.Dim(fmt.Sprintf("Stored %d messages. Held before: %d, hold now: %d", toWriteLength, holdingMessagesLength, len(holdingMessages))))
-		lockForHolding.Unlock()
-
-		// Reset the writing array, as data has been written to DB
-		writingMessages = []string{}
-		lockForWriting.Unlock() // Unlock writing array after DB storing completes
-	}
-
-	// If flushChan is set, flushing has been requested.
-	if flushChan != nil {
-		lockForHolding.Lock()
-		thereAreHoldingMessages := len(holdingMessages) >= 1
-		lockForHolding.Unlock()
-		if !thereAreHoldingMessages {
-			fmt.Println(rexprint.Dim("Flush requested: All messages stored in DB, flush complete."))
-			*flushChan <- true
-			flushChan = nil
-		} else {
-			if time.Now().Unix() > flushRequestTime.Unix()+maxFlushGraceSeconds {
-				fmt.Println(rexprint.ErrColor("Flush requested: There are pending messages to be stored in DB, but timeout was reached, will exit now"))
-				*flushChan <- true
-				flushChan = nil
-			} else {
-				fmt.Println(rexprint.Dim("Flush requested: There are pending messages to be stored in DB, will wait to flush..."))
-			}
+		if err != nil {
+			time.Sleep(r.spec.Interval)
 		}
 	}
+	if err := r.sink.Close(); err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("cannot close sink %s: %s", r.sink.Name(), err)))
+	}
 }
 
-func OnHiveMessage(message *hive_message.HiveMessage) {
-	lockForHolding.Lock()
-	message.TempId = genHiveMessageId()
-	message.Time = time.Now()
-	holdingMessages = append(holdingMessages, message)
-	lockForHolding.Unlock()
-}
-
-func genHiveRunId() string {
-	id, _ := uuid.NewRandom()
-	return id.String()
-}
-
-func genHiveMessageId() string {
-	id, _ := uuid.NewRandom()
-	return id.String()
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
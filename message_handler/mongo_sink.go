@@ -0,0 +1,205 @@
+package message_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/machine_meta"
+	"rex-hive-daemon/replica_registry"
+	"rex-hive-daemon/rexprint"
+	"time"
+)
+
+const databaseTimeoutSeconds = 5
+const mongoDatabaseName = "rex-hive"
+const mongoCollectionHiveMessage = "message"
+const mongoCollectionHiveRun = "run"
+const mongoCollectionHeartbeat = "heartbeat"
+
+// Heartbeat is written periodically while the daemon runs, so the backend can detect dead daemons and how loaded each
+// machine is.
+type Heartbeat struct {
+	HiveRunId    interface{}             `bson:"hiveRunId"`
+	Hostname     string                  `bson:"hostname"`
+	LiveReplicas int                     `bson:"liveReplicas"`
+	Host         *machine_meta.HostUsage `bson:"host"`
+	Time         time.Time               `bson:"time"`
+}
+
+// mongoSink stores the run, its messages and heartbeats of the machine in MongoDB, at the MONGODB_URI of the .env
+// file.
+type mongoSink struct {
+	heartbeatInterval time.Duration
+	machineMeta       *machine_meta.MachineMeta
+	hiveRunId         interface{}
+	stopHeartbeats    chan bool
+}
+
+func (s *mongoSink) Name() string { return hive_spec.SinkMongo }
+
+func (s *mongoSink) Open(hiveSpec *hive_spec.HiveSpec) error {
+	// Get machine metadata
+	s.machineMeta = machine_meta.GetMachineMeta()
+	hiveSpec.RuntimeMachine = s.machineMeta
+	hiveSpec.Id = genHiveRunId()
+	hiveSpec.Time = time.Now()
+
+	// The ID is generated here, so messages refer to the run even before it's inserted
+	s.hiveRunId = hiveSpec.Id
+	err := s.insertRun(hiveSpec)
+
+	// Heartbeats refer to the run, while it isn't inserted they retry inserting it instead
+	s.stopHeartbeats = make(chan bool)
+	go s.sendHeartbeats(hiveSpec, err == nil)
+	if err != nil {
+		return fmt.Errorf("cannot insert hive run, retrying every %s: %w", s.heartbeatInterval, err)
+	}
+	return nil
+}
+
+func (s *mongoSink) insertRun(hiveSpec *hive_spec.HiveSpec) error {
+	// Sensitive values are only masked in the stored copy of the spec
+	if _, err := insertOne(mongoCollectionHiveRun, hiveSpec.Redacted()); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	rexprint.Println(rexprint.OutColor(fmt.Sprintf("hive run inserted with ID %s", s.hiveRunId)))
+	return nil
+}
+
+func (s *mongoSink) Write(batch []*hive_message.HiveMessage) error {
+	docs := make([]interface{}, len(batch))
+	for i, m := range batch {
+		// Messages are shared with the other sinks, add machine meta to a copy right before sending it to DB
+		doc := *m
+		doc.RuntimeMachine = s.machineMeta
+		doc.HiveRunId = s.hiveRunId
+		docs[i] = &doc
+	}
+	_, err := insertMany(mongoCollectionHiveMessage, docs)
+	if onlyDuplicateKeys(err) {
+		// The messages were already inserted by a previous write of the batch that failed halfway
+		return nil
+	}
+	return err
+}
+
+// onlyDuplicateKeys tells if all the errors of an insert are about documents that already exist.
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) <= 0 {
+		return false
+	}
+	for _, e := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *mongoSink) Flush() error {
+	return nil
+}
+
+func (s *mongoSink) Close() error {
+	if s.stopHeartbeats != nil {
+		close(s.stopHeartbeats)
+	}
+	return nil
+}
+
+// sendHeartbeats writes a heartbeat with the usage of the machine every heartbeatInterval, once the run is inserted.
+func (s *mongoSink) sendHeartbeats(hiveSpec *hive_spec.HiveSpec, runInserted bool) {
+	sampler := machine_meta.NewHostSampler()
+	for {
+		select {
+		case <-s.stopHeartbeats:
+			return
+		case <-time.After(s.heartbeatInterval):
+		}
+		if !runInserted {
+			if err := s.insertRun(hiveSpec); err != nil {
+				rexprint.Println("cannot insert hive run in mongodb", rexprint.ErrColor(err.Error()))
+				continue
+			}
+			runInserted = true
+		}
+		h := &Heartbeat{
+			HiveRunId:    s.hiveRunId,
+			Hostname:     s.machineMeta.Hostname,
+			LiveReplicas: replica_registry.Count(),
+			Host:         sampler.Sample(),
+			Time:         time.Now(),
+		}
+		if _, err := insertOne(mongoCollectionHeartbeat, h); err != nil {
+			rexprint.Println("cannot insert heartbeat in mongodb", rexprint.ErrColor(err.Error()))
+		}
+	}
+}
+
+func connectDb() (*mongo.Client, error) {
+	// Get connection string
+	if err := godotenv.Load(); err != nil {
+		return nil, errors.New("no .env file found")
+	}
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		return nil, errors.New("You must set your 'MONGODB_URI' environmental variable. See\n\t https://www.mongodb.com/docs/drivers/go/current/usage-examples/#environment-variable")
+	}
+
+	// Connect to database
+	t := databaseTimeoutSeconds * time.Second
+	opts := options.Client().ApplyURI(uri).SetTimeout(t).SetConnectTimeout(t).SetSocketTimeout(t).SetServerSelectionTimeout(t)
+	return mongo.Connect(context.TODO(), opts)
+}
+
+func insertOne(collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	// Get DB connection
+	client, err := connectDb()
+	if err != nil {
+		return nil, err
+	}
+
+	// Disconnect from DB on exit
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			rexprint.Println(rexprint.ErrColor(err.Error()))
+		}
+	}()
+
+	// Get DB collection
+	coll := client.Database(mongoDatabaseName).Collection(collection)
+	return coll.InsertOne(context.TODO(), document)
+}
+
+func insertMany(collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
+	// Get DB connection
+	client, err := connectDb()
+	if err != nil {
+		return nil, err
+	}
+
+	// Disconnect from DB on exit
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			rexprint.Println(rexprint.ErrColor(err.Error()))
+		}
+	}()
+
+	// Get DB collection
+	// Unordered, so documents that already exist don't stop the rest from being inserted
+	coll := client.Database(mongoDatabaseName).Collection(collection)
+	return coll.InsertMany(context.TODO(), documents, options.InsertMany().SetOrdered(false))
+}
+
+func genHiveRunId() string {
+	id, _ := uuid.NewRandom()
+	return id.String()
+}
@@ -0,0 +1,36 @@
+package message_handler
+
+import (
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/otlp_export"
+)
+
+// otlpSink exports the messages as OTLP log records and the attempts of the replicas as spans, configured by the
+// `OTEL_*` env vars.
+type otlpSink struct {
+	processName func(index int) string
+}
+
+func (s *otlpSink) Name() string { return hive_spec.SinkOtlp }
+
+func (s *otlpSink) Open(*hive_spec.HiveSpec) error {
+	return nil
+}
+
+// Write turns the messages into log records and spans buffered by the exporter. They're only sent by Flush, which is
+// retried while the collector is failing, so a batch is never turned into log records twice.
+func (s *otlpSink) Write(batch []*hive_message.HiveMessage) error {
+	for _, m := range batch {
+		otlp_export.OnHiveMessage(m, s.processName(m.Index))
+	}
+	return nil
+}
+
+func (s *otlpSink) Flush() error {
+	return otlp_export.Flush()
+}
+
+func (s *otlpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"rex-hive-daemon/hive_spec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multilineAggregator groups consecutive lines of a single stream following a multiline spec, and sends each group as
+// a single message.
+type multilineAggregator struct {
+	spec *hive_spec.MultilineSpec
+	send func(data string)
+	// Locks lines and timer, since the timer flushes from its own goroutine.
+	lock  sync.Mutex
+	lines []string
+	timer *time.Timer
+}
+
+func newMultilineAggregator(spec *hive_spec.MultilineSpec, send func(data string)) *multilineAggregator {
+	return &multilineAggregator{spec: spec, send: send}
+}
+
+func (m *multilineAggregator) add(line string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.lines) > 0 && !m.continues(line) {
+		m.flushLocked()
+	}
+	m.lines = append(m.lines, line)
+	if len(m.lines) >= m.spec.MaxLines {
+		m.flushLocked()
+		return
+	}
+
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.spec.FlushTimeout, m.flush)
+	} else {
+		m.timer.Reset(m.spec.FlushTimeout)
+	}
+}
+
+// continues tells if the line belongs to the current group.
+func (m *multilineAggregator) continues(line string) bool {
+	if m.spec.ContinuationRegex != nil {
+		return m.spec.ContinuationRegex.MatchString(line)
+	}
+	return !m.spec.StartRegex.MatchString(line)
+}
+
+// flush sends the current group, if any.
+func (m *multilineAggregator) flush() {
+	m.lock.Lock()
+	m.flushLocked()
+	m.lock.Unlock()
+}
+
+func (m *multilineAggregator) flushLocked() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	if len(m.lines) <= 0 {
+		return
+	}
+	m.send(strings.Join(m.lines, "\n"))
+	m.lines = nil
+}
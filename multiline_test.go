@@ -0,0 +1,96 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"rex-hive-daemon/hive_spec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func parseMultilineSpec(t *testing.T, spec string) *hive_spec.MultilineSpec {
+	t.Helper()
+	m := &hive_spec.MultilineSpec{}
+	if err := yaml.Unmarshal([]byte(spec), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMultilineAggregator(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		lines []string
+		want  []string
+	}{
+		{"start pattern", `start: '^\d{4}-'`, []string{
+			"2024-01-02 panic", "  at main.go:10", "  at main.go:20", "2024-01-02 recovered",
+		}, []string{
+			"2024-01-02 panic\n  at main.go:10\n  at main.go:20", "2024-01-02 recovered",
+		}},
+		{"lines before the first start are grouped", `start: '^\d{4}-'`, []string{
+			"booting", "still booting", "2024-01-02 ready",
+		}, []string{
+			"booting\nstill booting", "2024-01-02 ready",
+		}},
+		{"continuation pattern", `continuation: '^\s'`, []string{
+			"Traceback", "  File a.py", "Error", "next",
+		}, []string{
+			"Traceback\n  File a.py", "Error", "next",
+		}},
+		{"continuation wins over start", "{start: '^x', continuation: '^\\s'}", []string{
+			"a", " b", "c",
+		}, []string{
+			"a\n b", "c",
+		}},
+		{"max lines", `{start: '^S', maxLines: 2}`, []string{
+			"S", "1", "2", "3", "S",
+		}, []string{
+			"S\n1", "2\n3", "S",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			m := newMultilineAggregator(parseMultilineSpec(t, tt.spec), func(data string) { got = append(got, data) })
+			for _, line := range tt.lines {
+				m.add(line)
+			}
+			m.flush()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultilineAggregatorFlushTimeout(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	sent := make(chan bool, 1)
+	m := newMultilineAggregator(parseMultilineSpec(t, `{start: '^S', flushTimeout: 20ms}`), func(data string) {
+		lock.Lock()
+		got = append(got, data)
+		lock.Unlock()
+		sent <- true
+	})
+
+	m.add("S")
+	m.add("1")
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("the group wasn't sent after the flush timeout")
+	}
+	// A line after the timeout starts a new group even if it would continue the previous one
+	m.add("2")
+	m.flush()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"S\n1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,453 @@
+package otlp_export
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/rexprint"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scopeName = "rex-hive-daemon"
+const defaultServiceName = "rex-hive-daemon"
+const defaultTimeout = 10 * time.Second
+
+// Max amount of log records or spans buffered, older ones are dropped when the collector can't keep up.
+const maxBuffered = 10000
+
+const (
+	protocolJson     = "http/json"
+	protocolProtobuf = "http/protobuf"
+)
+
+// Config of the exporter, read from the standard `OTEL_*` env vars.
+type Config struct {
+	LogsEndpoint   string
+	TracesEndpoint string
+	// LogsProtocol and TracesProtocol are either `http/json` or `http/protobuf`
+	LogsProtocol   string
+	TracesProtocol string
+	Headers        map[string]string
+	Timeout        time.Duration
+	Resource       []keyValue
+}
+
+// attemptSpan is the open span of a running attempt of a replica.
+type attemptSpan struct {
+	span    *span
+	attempt int
+}
+
+var (
+	config *Config
+	logs   []*logRecord
+	spans  []*span
+	// Open spans by replica index
+	openSpans = map[int]*attemptSpan{}
+	// Backoff delays before the next attempt, by replica index
+	backoffs = map[int]time.Duration{}
+	dropped  int
+	// Locks reads and writes to config, logs, spans, openSpans, backoffs and dropped.
+	lock sync.Mutex
+	// Locks exporting, so batches are sent in order.
+	exportLock sync.Mutex
+)
+
+// Configure reads the config of the exporter from the env. The exporter is enabled when an OTLP endpoint is set, eg:
+// `OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318`. The `http/json` and `http/protobuf` protocols are supported, a
+// signal with another protocol, eg: `grpc`, is not exported.
+func Configure(getenv func(string) string) error {
+	if strings.EqualFold(getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil
+	}
+
+	c := &Config{Headers: map[string]string{}, Timeout: defaultTimeout}
+	base := strings.TrimRight(getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/")
+	c.LogsEndpoint = signalEndpoint(getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"), base, "/v1/logs", getenv("OTEL_LOGS_EXPORTER"))
+	c.TracesEndpoint = signalEndpoint(getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), base, "/v1/traces", getenv("OTEL_TRACES_EXPORTER"))
+	c.LogsProtocol = firstOf(getenv("OTEL_EXPORTER_OTLP_LOGS_PROTOCOL"), getenv("OTEL_EXPORTER_OTLP_PROTOCOL"), protocolJson)
+	c.TracesProtocol = firstOf(getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"), getenv("OTEL_EXPORTER_OTLP_PROTOCOL"), protocolJson)
+	c.LogsEndpoint = supportedProtocol(c.LogsEndpoint, c.LogsProtocol, "logs")
+	c.TracesEndpoint = supportedProtocol(c.TracesEndpoint, c.TracesProtocol, "traces")
+	if c.LogsEndpoint == "" && c.TracesEndpoint == "" {
+		return nil
+	}
+
+	// Eg: `api-key=secret,tenant=rex`, values are URL encoded
+	headers, err := parseKeyValues(getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+	}
+	c.Headers = headers
+	if t := getenv("OTEL_EXPORTER_OTLP_TIMEOUT"); t != "" {
+		ms, err := strconv.Atoi(t)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT '%s', expected milliseconds", t)
+		}
+		c.Timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	attributes, err := parseKeyValues(getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	if name := getenv("OTEL_SERVICE_NAME"); name != "" {
+		attributes["service.name"] = name
+	} else if attributes["service.name"] == "" {
+		attributes["service.name"] = defaultServiceName
+	}
+	if hostname, err := os.Hostname(); err == nil && attributes["host.name"] == "" {
+		attributes["host.name"] = hostname
+	}
+	for k, v := range attributes {
+		c.Resource = append(c.Resource, stringAttr(k, v))
+	}
+
+	lock.Lock()
+	config = c
+	lock.Unlock()
+	return nil
+}
+
+// Enabled tells if any signal is exported.
+func Enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return config != nil
+}
+
+// signalEndpoint returns the endpoint of a signal: its own endpoint as is, or the path of the signal appended to the
+// base endpoint. Empty when the exporter of the signal is `none`.
+func signalEndpoint(endpoint string, base string, path string, exporter string) string {
+	if exporter == "none" {
+		return ""
+	}
+	if endpoint != "" {
+		return endpoint
+	}
+	if base != "" {
+		return base + path
+	}
+	return ""
+}
+
+// supportedProtocol returns the endpoint of a signal, or empty with a warning if its protocol is not supported.
+func supportedProtocol(endpoint string, protocol string, signal string) string {
+	if endpoint == "" || protocol == protocolJson || protocol == protocolProtobuf {
+		return endpoint
+	}
+	rexprint.Println(rexprint.ErrColor(fmt.Sprintf("OTLP protocol '%s' is not supported, %s are not exported. Supported protocols: %s, %s", protocol, signal, protocolProtobuf, protocolJson)))
+	return ""
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseKeyValues parses the `key1=value1,key2=value2` format of the OTEL env vars, with URL encoded values.
+func parseKeyValues(s string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("missing '=' in '%s'", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSpace(key)] = decoded
+	}
+	return result, nil
+}
+
+// Backoff records the delay before the next attempt of the replica, added to the span of that attempt.
+func Backoff(index int, delay time.Duration) {
+	lock.Lock()
+	backoffs[index] = delay
+	lock.Unlock()
+}
+
+// OnHiveMessage turns the message into a log record and opens or closes the span of the attempt of the replica on
+// started, exited or aborted messages. name is the name of the process of the replica.
+func OnHiveMessage(message *hive_message.HiveMessage, name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if config == nil {
+		return
+	}
+	// Messages are exported in batches, use the time they were received at when set
+	now := message.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	attributes := []keyValue{
+		stringAttr("rex.process.name", name),
+		intAttr("rex.replica.index", int64(message.Index)),
+		intAttr("rex.attempt", int64(message.Attempt)),
+		stringAttr("rex.message.type", string(message.Type)),
+	}
+	if message.Pid >= 0 {
+		attributes = append(attributes, intAttr("process.pid", int64(message.Pid)))
+	}
+
+	// Span the log record belongs to
+	var link *span
+	if open, ok := openSpans[message.Index]; ok && open.attempt == message.Attempt {
+		link = open.span
+	}
+
+	switch message.Type {
+	case hive_message.ProcessStarted:
+		s := &span{
+			TraceId:           randomHex(16),
+			SpanId:            randomHex(8),
+			Name:              name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: unixNano(now),
+			Attributes:        append([]keyValue(nil), attributes[:3]...),
+		}
+		s.Attributes = append(s.Attributes, intAttr("process.pid", int64(message.Pid)))
+		if delay, ok := backoffs[message.Index]; ok {
+			s.Attributes = append(s.Attributes, doubleAttr("rex.backoff.seconds", delay.Seconds()))
+			delete(backoffs, message.Index)
+		}
+		openSpans[message.Index] = &attemptSpan{span: s, attempt: message.Attempt}
+		link = s
+	case hive_message.ProcessOomKilled:
+		if link != nil {
+			link.Attributes = append(link.Attributes, boolAttr("rex.oom_killed", true))
+		}
+	case hive_message.ProcessExited, hive_message.ProcessAborted:
+		s := endSpan(message, name, attributes, now)
+		s.Attributes = append(s.Attributes, intAttr("process.exit.code", int64(message.ExitCode)))
+		if message.Exit != nil {
+			if message.Exit.Signal != "" {
+				s.Attributes = append(s.Attributes, stringAttr("rex.exit.signal", message.Exit.Signal))
+			}
+			s.Attributes = append(s.Attributes, boolAttr("rex.exit.core_dumped", message.Exit.CoreDumped))
+		}
+		if message.Type == hive_message.ProcessAborted || message.ExitCode != 0 {
+			s.Status = status{Code: statusCodeError, Message: message.Data}
+		} else {
+			s.Status = status{Code: statusCodeOk}
+		}
+		spans = appendBounded(spans, s)
+		link = s
+	}
+
+	if config.LogsEndpoint == "" {
+		return
+	}
+	r := &logRecord{
+		TimeUnixNano:         unixNano(now),
+		ObservedTimeUnixNano: unixNano(time.Now()),
+		Attributes:           attributes,
+	}
+	if message.Timestamp != nil {
+		r.TimeUnixNano = unixNano(*message.Timestamp)
+	}
+	if link != nil {
+		r.TraceId, r.SpanId = link.TraceId, link.SpanId
+	}
+	body := message.Data
+	switch message.Type {
+	case hive_message.ProcessMetrics:
+		b, _ := json.Marshal(message.Metrics)
+		body = string(b)
+	case hive_message.ProcessStdOut, hive_message.ProcessStdErr:
+		if message.Message != "" {
+			body = message.Message
+		}
+	}
+	if body == "" {
+		body = string(message.Type)
+	}
+	r.Body = anyValue{StringValue: &body}
+	r.SeverityNumber, r.SeverityText = severityOf(message)
+	if len(logs) >= maxBuffered {
+		logs = logs[1:]
+		dropped++
+	}
+	logs = append(logs, r)
+}
+
+// endSpan removes and returns the open span of the attempt, or a span with no duration if it never started.
+func endSpan(message *hive_message.HiveMessage, name string, attributes []keyValue, now time.Time) *span {
+	open, ok := openSpans[message.Index]
+	if ok && open.attempt == message.Attempt {
+		delete(openSpans, message.Index)
+		open.span.EndTimeUnixNano = unixNano(now)
+		return open.span
+	}
+	return &span{
+		TraceId:           randomHex(16),
+		SpanId:            randomHex(8),
+		Name:              name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: unixNano(now),
+		EndTimeUnixNano:   unixNano(now),
+		Attributes:        append([]keyValue(nil), attributes[:3]...),
+	}
+}
+
+func appendBounded(s []*span, sp *span) []*span {
+	if len(s) >= maxBuffered {
+		dropped++
+		s = s[1:]
+	}
+	return append(s, sp)
+}
+
+// severityOf returns the severity of the message: the level of JSON output lines, error for failed exits.
+func severityOf(message *hive_message.HiveMessage) (int, string) {
+	switch message.Type {
+	case hive_message.ProcessAborted, hive_message.ProcessOomKilled:
+		return severityError, "ERROR"
+	case hive_message.ProcessExited:
+		if message.ExitCode != 0 {
+			return severityError, "ERROR"
+		}
+		return severityInfo, "INFO"
+	case hive_message.ProcessStarted, hive_message.ProcessMetrics:
+		return severityInfo, "INFO"
+	}
+	switch strings.ToLower(message.Level) {
+	case "trace", "debug":
+		return severityDebug, strings.ToUpper(message.Level)
+	case "info", "notice":
+		return severityInfo, strings.ToUpper(message.Level)
+	case "warn", "warning":
+		return severityWarn, strings.ToUpper(message.Level)
+	case "error", "err":
+		return severityError, strings.ToUpper(message.Level)
+	case "fatal", "panic", "critical", "crit":
+		return severityFatal, strings.ToUpper(message.Level)
+	}
+	// Unknown for plain text lines
+	return 0, ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Flush exports the buffered log records and spans. Spans of attempts still running aren't exported. Log records and
+// spans that fail to be exported stay buffered, to be exported by the next call.
+func Flush() error {
+	exportLock.Lock()
+	defer exportLock.Unlock()
+
+	lock.Lock()
+	c := config
+	pendingLogs, pendingSpans, droppedCount := logs, spans, dropped
+	logs, spans, dropped = nil, nil, 0
+	lock.Unlock()
+	if c == nil {
+		return nil
+	}
+
+	if droppedCount > 0 {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("OTLP export can't keep up, dropped %d log records and spans", droppedCount)))
+	}
+	var errs []string
+	if len(pendingLogs) > 0 && c.LogsEndpoint != "" {
+		req := logsRequest{ResourceLogs: []resourceLogs{{
+			Resource:  resource{Attributes: c.Resource},
+			ScopeLogs: []scopeLogs{{Scope: scope{Name: scopeName}, LogRecords: pendingLogs}},
+		}}}
+		if err := post(c, c.LogsEndpoint, c.LogsProtocol, req, req.marshalProto); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot export %d log records: %s", len(pendingLogs), err))
+			lock.Lock()
+			logs = keepNewest(append(pendingLogs, logs...))
+			lock.Unlock()
+		}
+	}
+	if len(pendingSpans) > 0 && c.TracesEndpoint != "" {
+		req := tracesRequest{ResourceSpans: []resourceSpans{{
+			Resource:   resource{Attributes: c.Resource},
+			ScopeSpans: []scopeSpans{{Scope: scope{Name: scopeName}, Spans: pendingSpans}},
+		}}}
+		if err := post(c, c.TracesEndpoint, c.TracesProtocol, req, req.marshalProto); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot export %d spans: %s", len(pendingSpans), err))
+			lock.Lock()
+			spans = keepNewest(append(pendingSpans, spans...))
+			lock.Unlock()
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// keepNewest drops the oldest items of s over maxBuffered. Must be called with lock held.
+func keepNewest[T any](s []T) []T {
+	if len(s) <= maxBuffered {
+		return s
+	}
+	dropped += len(s) - maxBuffered
+	return s[len(s)-maxBuffered:]
+}
+
+// post sends the request, encoded as JSON or with marshalProto depending on the protocol.
+func post(c *Config, endpoint string, protocol string, body any, marshalProto func() []byte) error {
+	contentType := "application/json"
+	var b []byte
+	if protocol == protocolProtobuf {
+		contentType = "application/x-protobuf"
+		b = marshalProto()
+	} else {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		// Protobuf error responses aren't readable as is
+		if strings.HasPrefix(res.Header.Get("Content-Type"), "application/x-protobuf") {
+			return fmt.Errorf("status code %d", res.StatusCode)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("status code %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
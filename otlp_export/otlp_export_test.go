@@ -0,0 +1,314 @@
+package otlp_export
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"rex-hive-daemon/hive_message"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an in-process OTLP/HTTP collector, recording the JSON requests it gets by path.
+type receiver struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	// Amount of requests to fail before accepting them
+	failures int
+	requests map[string][]map[string]any
+}
+
+func newReceiver(t *testing.T, failures int) *receiver {
+	r := &receiver{failures: failures, requests: map[string][]map[string]any{}}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Api-Key") != "secret" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.failures > 0 {
+			r.failures--
+			http.Error(w, "collector unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		var body map[string]any
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("invalid JSON sent to %s: %s", req.URL.Path, err)
+		}
+		r.requests[req.URL.Path] = append(r.requests[req.URL.Path], body)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *receiver) received(path string) []map[string]any {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests[path]
+}
+
+// resetExporter clears the config and everything buffered by the exporter.
+func resetExporter() {
+	lock.Lock()
+	config, logs, spans, dropped = nil, nil, nil, 0
+	openSpans, backoffs = map[int]*attemptSpan{}, map[int]time.Duration{}
+	lock.Unlock()
+}
+
+// configure resets the state of the exporter and configures it to export to the receiver.
+func configure(t *testing.T, r *receiver) {
+	resetExporter()
+
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": r.server.URL + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Api-Key=secret",
+		"OTEL_SERVICE_NAME":           "game-servers",
+		"OTEL_RESOURCE_ATTRIBUTES":    "deployment.environment=test,team=rex%20hive",
+	}
+	if err := Configure(func(key string) string { return env[key] }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// path returns the value at the path of keys and array indexes of a decoded JSON document, nil if there's none.
+func path(v any, keys ...any) any {
+	for _, k := range keys {
+		switch k := k.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		case int:
+			a, ok := v.([]any)
+			if !ok || k >= len(a) {
+				return nil
+			}
+			v = a[k]
+		}
+	}
+	return v
+}
+
+// attributes returns the attributes of a decoded JSON document as a map of key to the JSON of their value.
+func attributes(v any) map[string]string {
+	result := map[string]string{}
+	list, _ := v.([]any)
+	for _, a := range list {
+		b, _ := json.Marshal(path(a, "value"))
+		result[path(a, "key").(string)] = string(b)
+	}
+	return result
+}
+
+func runAttempt() {
+	Backoff(0, 2*time.Second)
+	now := time.Now()
+	OnHiveMessage(&hive_message.HiveMessage{Index: 0, Pid: 100, Attempt: 1, Type: hive_message.ProcessStarted, Time: now}, "server")
+	OnHiveMessage(&hive_message.HiveMessage{Index: 0, Pid: 100, Attempt: 1, Type: hive_message.ProcessStdOut, Data: "hello", Time: now}, "server")
+	OnHiveMessage(&hive_message.HiveMessage{Index: 0, Pid: 100, Attempt: 1, Type: hive_message.ProcessStdErr, Data: `{"level":"warn","msg":"low"}`, Level: "warn", Message: "low", Time: now}, "server")
+	OnHiveMessage(&hive_message.HiveMessage{
+		Index:    0,
+		Pid:      100,
+		Attempt:  1,
+		Type:     hive_message.ProcessExited,
+		Data:     "exit status 1",
+		ExitCode: 1,
+		Exit:     &hive_message.ExitInfo{Signal: "SIGSEGV", CoreDumped: true},
+		Time:     now.Add(time.Second),
+	}, "server")
+}
+
+func TestExport(t *testing.T) {
+	r := newReceiver(t, 0)
+	configure(t, r)
+	runAttempt()
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	logRequests, traceRequests := r.received("/v1/logs"), r.received("/v1/traces")
+	if len(logRequests) != 1 || len(traceRequests) != 1 {
+		t.Fatalf("got %d log and %d trace requests, want 1 of each", len(logRequests), len(traceRequests))
+	}
+
+	// Resource attributes
+	for _, resourceAttributes := range []any{
+		path(logRequests[0], "resourceLogs", 0, "resource", "attributes"),
+		path(traceRequests[0], "resourceSpans", 0, "resource", "attributes"),
+	} {
+		attrs := attributes(resourceAttributes)
+		for key, want := range map[string]string{
+			"service.name":           `{"stringValue":"game-servers"}`,
+			"deployment.environment": `{"stringValue":"test"}`,
+			"team":                   `{"stringValue":"rex hive"}`,
+		} {
+			if attrs[key] != want {
+				t.Errorf("resource attribute %s = %s, want %s", key, attrs[key], want)
+			}
+		}
+		if attrs["host.name"] == "" {
+			t.Errorf("resource attributes %v have no host.name", attrs)
+		}
+	}
+	if scope := path(logRequests[0], "resourceLogs", 0, "scopeLogs", 0, "scope", "name"); scope != scopeName {
+		t.Errorf("scope name = %v, want %s", scope, scopeName)
+	}
+
+	// The span of the attempt
+	spanList, _ := path(traceRequests[0], "resourceSpans", 0, "scopeSpans", 0, "spans").([]any)
+	if len(spanList) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spanList))
+	}
+	s := spanList[0]
+	traceId, _ := path(s, "traceId").(string)
+	spanId, _ := path(s, "spanId").(string)
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(traceId) || !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(spanId) {
+		t.Errorf("trace id %q and span id %q aren't 16 and 8 bytes of hex", traceId, spanId)
+	}
+	if parent := path(s, "parentSpanId"); parent != nil {
+		t.Errorf("attempt span has parent %v, want a root span", parent)
+	}
+	if path(s, "name") != "server" || path(s, "kind") != float64(spanKindInternal) {
+		t.Errorf("span name and kind = %v, %v", path(s, "name"), path(s, "kind"))
+	}
+	if path(s, "status", "code") != float64(statusCodeError) || path(s, "status", "message") != "exit status 1" {
+		t.Errorf("span status = %v, want an error with the exit", path(s, "status"))
+	}
+	start, _ := path(s, "startTimeUnixNano").(string)
+	end, _ := path(s, "endTimeUnixNano").(string)
+	if len(start) != len(end) || start >= end {
+		t.Errorf("span starts at %s and ends at %s", start, end)
+	}
+	spanAttrs := attributes(path(s, "attributes"))
+	for key, want := range map[string]string{
+		"rex.process.name":     `{"stringValue":"server"}`,
+		"rex.replica.index":    `{"intValue":"0"}`,
+		"rex.attempt":          `{"intValue":"1"}`,
+		"process.pid":          `{"intValue":"100"}`,
+		"rex.backoff.seconds":  `{"doubleValue":2}`,
+		"process.exit.code":    `{"intValue":"1"}`,
+		"rex.exit.signal":      `{"stringValue":"SIGSEGV"}`,
+		"rex.exit.core_dumped": `{"boolValue":true}`,
+	} {
+		if spanAttrs[key] != want {
+			t.Errorf("span attribute %s = %s, want %s", key, spanAttrs[key], want)
+		}
+	}
+
+	// The log records, all linked to the span
+	records, _ := path(logRequests[0], "resourceLogs", 0, "scopeLogs", 0, "logRecords").([]any)
+	wantRecords := []struct {
+		body           string
+		severityNumber float64
+		severityText   string
+		messageType    string
+	}{
+		{"started", severityInfo, "INFO", "started"},
+		{"hello", 0, "", "stdout"},
+		{"low", severityWarn, "WARN", "stderr"},
+		{"exit status 1", severityError, "ERROR", "exited"},
+	}
+	if len(records) != len(wantRecords) {
+		t.Fatalf("got %d log records, want %d", len(records), len(wantRecords))
+	}
+	for i, want := range wantRecords {
+		rec := records[i]
+		if body := path(rec, "body", "stringValue"); body != want.body {
+			t.Errorf("record %d body = %v, want %s", i, body, want.body)
+		}
+		severityNumber, _ := path(rec, "severityNumber").(float64)
+		severityText, _ := path(rec, "severityText").(string)
+		if severityNumber != want.severityNumber || severityText != want.severityText {
+			t.Errorf("record %d severity = %v %v, want %v %v", i, severityNumber, severityText, want.severityNumber, want.severityText)
+		}
+		if attrs := attributes(path(rec, "attributes")); attrs["rex.message.type"] != `{"stringValue":"`+want.messageType+`"}` {
+			t.Errorf("record %d message type = %s, want %s", i, attrs["rex.message.type"], want.messageType)
+		}
+		if path(rec, "traceId") != traceId || path(rec, "spanId") != spanId {
+			t.Errorf("record %d is linked to %v/%v, want the span of the attempt %s/%s", i, path(rec, "traceId"), path(rec, "spanId"), traceId, spanId)
+		}
+	}
+}
+
+func TestExportFailure(t *testing.T) {
+	// The first logs and traces requests fail
+	r := newReceiver(t, 2)
+	configure(t, r)
+	runAttempt()
+
+	err := Flush()
+	if err == nil || !strings.Contains(err.Error(), "status code 503") {
+		t.Fatalf("Flush() error = %v, want the status code of the collector", err)
+	}
+	if len(r.received("/v1/logs")) != 0 || len(r.received("/v1/traces")) != 0 {
+		t.Fatal("failed requests were recorded")
+	}
+
+	// Nothing is lost, the next flush exports what failed
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := path(r.received("/v1/logs")[0], "resourceLogs", 0, "scopeLogs", 0, "logRecords").([]any)
+	spanList, _ := path(r.received("/v1/traces")[0], "resourceSpans", 0, "scopeSpans", 0, "spans").([]any)
+	if len(records) != 4 || len(spanList) != 1 {
+		t.Errorf("got %d log records and %d spans after the retry, want 4 and 1", len(records), len(spanList))
+	}
+
+	// Nothing is exported twice
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.received("/v1/logs")) != 1 || len(r.received("/v1/traces")) != 1 {
+		t.Errorf("got %d log and %d trace requests, want 1 of each", len(r.received("/v1/logs")), len(r.received("/v1/traces")))
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantErr    bool
+		wantLogs   string
+		wantTraces string
+	}{
+		{"disabled without endpoint", map[string]string{}, false, "", ""},
+		{"base endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/"}, false, "http://collector:4318/v1/logs", "http://collector:4318/v1/traces"},
+		{"signal endpoints as is", map[string]string{"OTEL_EXPORTER_OTLP_LOGS_ENDPOINT": "http://logs/custom"}, false, "http://logs/custom", ""},
+		{"traces exporter none", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_EXPORTER": "none"}, false, "http://collector:4318/v1/logs", ""},
+		{"sdk disabled", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}, false, "", ""},
+		{"grpc is not exported", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, false, "", ""},
+		{"protocol per signal", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "grpc"}, false, "http://collector:4318/v1/logs", ""},
+		{"invalid timeout", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_TIMEOUT": "1s"}, true, "", ""},
+		{"invalid headers", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_HEADERS": "no-value"}, true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock.Lock()
+			config = nil
+			lock.Unlock()
+
+			err := Configure(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Configure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var logsEndpoint, tracesEndpoint string
+			if c := config; c != nil {
+				logsEndpoint, tracesEndpoint = c.LogsEndpoint, c.TracesEndpoint
+			}
+			if logsEndpoint != tt.wantLogs || tracesEndpoint != tt.wantTraces {
+				t.Errorf("endpoints = %q, %q, want %q, %q", logsEndpoint, tracesEndpoint, tt.wantLogs, tt.wantTraces)
+			}
+			if Enabled() != (tt.wantLogs != "" || tt.wantTraces != "") {
+				t.Errorf("Enabled() = %v", Enabled())
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package otlp_export
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+)
+
+// Protobuf encoding of the OTLP/HTTP requests, see https://github.com/open-telemetry/opentelemetry-proto. Only the
+// fields the daemon sets are encoded, with the field numbers of the .proto files.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuffer appends the fields of a protobuf message.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field int, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wire))
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.tag(field, wireVarint)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// message appends the embedded message written by encode.
+func (b *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.bytes(field, m)
+}
+
+// unixNanoField appends a timestamp of the JSON encoding, a decimal string.
+func (b *protoBuffer) unixNanoField(field int, v string) {
+	if n, err := strconv.ParseUint(v, 10, 64); err == nil && n > 0 {
+		b.fixed64(field, n)
+	}
+}
+
+// idField appends a trace or span ID of the JSON encoding, a hex string.
+func (b *protoBuffer) idField(field int, v string) {
+	if id, err := hex.DecodeString(v); err == nil && len(id) > 0 {
+		b.bytes(field, id)
+	}
+}
+
+// AnyValue: string_value = 1, bool_value = 2, int_value = 3, double_value = 4
+func (v anyValue) encode(b *protoBuffer) {
+	switch {
+	case v.StringValue != nil:
+		// Set even if empty, it's a oneof
+		b.bytes(1, []byte(*v.StringValue))
+	case v.BoolValue != nil:
+		n := uint64(0)
+		if *v.BoolValue {
+			n = 1
+		}
+		b.varint(2, n)
+	case v.IntValue != nil:
+		n, _ := strconv.ParseInt(*v.IntValue, 10, 64)
+		b.varint(3, uint64(n))
+	case v.DoubleValue != nil:
+		b.fixed64(4, math.Float64bits(*v.DoubleValue))
+	}
+}
+
+// KeyValue: key = 1, value = 2
+func encodeAttributes(b *protoBuffer, field int, attributes []keyValue) {
+	for _, kv := range attributes {
+		b.message(field, func(m *protoBuffer) {
+			m.string(1, kv.Key)
+			m.message(2, kv.Value.encode)
+		})
+	}
+}
+
+// Resource: attributes = 1
+func (r resource) encode(b *protoBuffer) {
+	encodeAttributes(b, 1, r.Attributes)
+}
+
+// InstrumentationScope: name = 1
+func (s scope) encode(b *protoBuffer) {
+	b.string(1, s.Name)
+}
+
+// LogRecord: time_unix_nano = 1, severity_number = 2, severity_text = 3, body = 5, attributes = 6, trace_id = 9,
+// span_id = 10, observed_time_unix_nano = 11
+func (r *logRecord) encode(b *protoBuffer) {
+	b.unixNanoField(1, r.TimeUnixNano)
+	if r.SeverityNumber != 0 {
+		b.varint(2, uint64(r.SeverityNumber))
+	}
+	b.string(3, r.SeverityText)
+	b.message(5, r.Body.encode)
+	encodeAttributes(b, 6, r.Attributes)
+	b.idField(9, r.TraceId)
+	b.idField(10, r.SpanId)
+	b.unixNanoField(11, r.ObservedTimeUnixNano)
+}
+
+// ExportLogsServiceRequest: resource_logs = 1. ResourceLogs: resource = 1, scope_logs = 2. ScopeLogs: scope = 1,
+// log_records = 2
+func (req logsRequest) marshalProto() []byte {
+	var b protoBuffer
+	for _, rl := range req.ResourceLogs {
+		b.message(1, func(m *protoBuffer) {
+			m.message(1, rl.Resource.encode)
+			for _, sl := range rl.ScopeLogs {
+				m.message(2, func(m *protoBuffer) {
+					m.message(1, sl.Scope.encode)
+					for _, r := range sl.LogRecords {
+						m.message(2, r.encode)
+					}
+				})
+			}
+		})
+	}
+	return b
+}
+
+// Status: message = 2, code = 3
+func (s status) encode(b *protoBuffer) {
+	b.string(2, s.Message)
+	if s.Code != 0 {
+		b.varint(3, uint64(s.Code))
+	}
+}
+
+// Span: trace_id = 1, span_id = 2, name = 5, kind = 6, start_time_unix_nano = 7, end_time_unix_nano = 8,
+// attributes = 9, status = 15
+func (s *span) encode(b *protoBuffer) {
+	b.idField(1, s.TraceId)
+	b.idField(2, s.SpanId)
+	b.string(5, s.Name)
+	if s.Kind != 0 {
+		b.varint(6, uint64(s.Kind))
+	}
+	b.unixNanoField(7, s.StartTimeUnixNano)
+	b.unixNanoField(8, s.EndTimeUnixNano)
+	encodeAttributes(b, 9, s.Attributes)
+	b.message(15, s.Status.encode)
+}
+
+// ExportTraceServiceRequest: resource_spans = 1. ResourceSpans: resource = 1, scope_spans = 2. ScopeSpans: scope = 1,
+// spans = 2
+func (req tracesRequest) marshalProto() []byte {
+	var b protoBuffer
+	for _, rs := range req.ResourceSpans {
+		b.message(1, func(m *protoBuffer) {
+			m.message(1, rs.Resource.encode)
+			for _, ss := range rs.ScopeSpans {
+				m.message(2, func(m *protoBuffer) {
+					m.message(1, ss.Scope.encode)
+					for _, s := range ss.Spans {
+						m.message(2, s.encode)
+					}
+				})
+			}
+		})
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package otlp_export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protoFields are the decoded fields of a protobuf message by number: uint64 for varint and fixed64 fields, []byte for
+// length-delimited ones.
+type protoFields map[int][]any
+
+func decodeProto(t *testing.T, b []byte) protoFields {
+	t.Helper()
+	fields := protoFields{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", b)
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint of field %d", field)
+			}
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("truncated fixed64 of field %d", field)
+			}
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("truncated bytes of field %d", field)
+			}
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", tag&7, field)
+		}
+	}
+	return fields
+}
+
+// messages decodes the repeated embedded messages of the field.
+func (f protoFields) messages(t *testing.T, field int) []protoFields {
+	var result []protoFields
+	for _, v := range f[field] {
+		result = append(result, decodeProto(t, v.([]byte)))
+	}
+	return result
+}
+
+func (f protoFields) message(t *testing.T, field int) protoFields {
+	m := f.messages(t, field)
+	if len(m) != 1 {
+		t.Fatalf("field %d has %d messages, want 1", field, len(m))
+	}
+	return m[0]
+}
+
+func (f protoFields) string(field int) string {
+	if len(f[field]) == 0 {
+		return ""
+	}
+	return string(f[field][0].([]byte))
+}
+
+func (f protoFields) uint(field int) uint64 {
+	if len(f[field]) == 0 {
+		return 0
+	}
+	return f[field][0].(uint64)
+}
+
+// protoAttributes returns the KeyValue messages of the field by key, as AnyValue messages.
+func protoAttributes(t *testing.T, f protoFields, field int) map[string]protoFields {
+	result := map[string]protoFields{}
+	for _, kv := range f.messages(t, field) {
+		result[kv.string(1)] = kv.message(t, 2)
+	}
+	return result
+}
+
+func TestExportProtobuf(t *testing.T) {
+	var requestsLock sync.Mutex
+	requests := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		requestsLock.Lock()
+		requests[req.URL.Path] = b
+		requestsLock.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	resetExporter()
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": server.URL,
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf",
+		"OTEL_SERVICE_NAME":           "game-servers",
+	}
+	if err := Configure(func(key string) string { return env[key] }); err != nil {
+		t.Fatal(err)
+	}
+	runAttempt()
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ExportTraceServiceRequest > ResourceSpans > ScopeSpans > Span
+	resourceSpans := decodeProto(t, requests["/v1/traces"]).message(t, 1)
+	if name := protoAttributes(t, resourceSpans.message(t, 1), 1)["service.name"].string(1); name != "game-servers" {
+		t.Errorf("service.name = %q, want game-servers", name)
+	}
+	scopeSpans := resourceSpans.message(t, 2)
+	if name := scopeSpans.message(t, 1).string(1); name != scopeName {
+		t.Errorf("scope name = %q, want %s", name, scopeName)
+	}
+	s := scopeSpans.message(t, 2)
+	traceId, spanId := s[1][0].([]byte), s[2][0].([]byte)
+	if len(traceId) != 16 || len(spanId) != 8 {
+		t.Errorf("trace id %x and span id %x aren't 16 and 8 bytes", traceId, spanId)
+	}
+	if s.string(5) != "server" || s.uint(6) != spanKindInternal {
+		t.Errorf("span name and kind = %q, %d", s.string(5), s.uint(6))
+	}
+	if start, end := s.uint(7), s.uint(8); start == 0 || end-start != uint64(time.Second) {
+		t.Errorf("span starts at %d and ends at %d, want a second later", start, end)
+	}
+	if status := s.message(t, 15); status.uint(3) != statusCodeError || status.string(2) != "exit status 1" {
+		t.Errorf("span status = %d %q, want an error with the exit", status.uint(3), status.string(2))
+	}
+	spanAttrs := protoAttributes(t, s, 9)
+	if v := spanAttrs["process.pid"].uint(3); v != 100 {
+		t.Errorf("process.pid = %d, want 100", v)
+	}
+	if v := math.Float64frombits(spanAttrs["rex.backoff.seconds"].uint(4)); v != 2 {
+		t.Errorf("rex.backoff.seconds = %v, want 2", v)
+	}
+	if v := spanAttrs["rex.exit.core_dumped"].uint(2); v != 1 {
+		t.Errorf("rex.exit.core_dumped = %d, want true", v)
+	}
+
+	// ExportLogsServiceRequest > ResourceLogs > ScopeLogs > LogRecord
+	records := decodeProto(t, requests["/v1/logs"]).message(t, 1).message(t, 2).messages(t, 2)
+	wantRecords := []struct {
+		body           string
+		severityNumber uint64
+		severityText   string
+	}{
+		{"started", severityInfo, "INFO"},
+		{"hello", 0, ""},
+		{"low", severityWarn, "WARN"},
+		{"exit status 1", severityError, "ERROR"},
+	}
+	if len(records) != len(wantRecords) {
+		t.Fatalf("got %d log records, want %d", len(records), len(wantRecords))
+	}
+	for i, want := range wantRecords {
+		rec := records[i]
+		if body := rec.message(t, 5).string(1); body != want.body {
+			t.Errorf("record %d body = %q, want %q", i, body, want.body)
+		}
+		if rec.uint(2) != want.severityNumber || rec.string(3) != want.severityText {
+			t.Errorf("record %d severity = %d %q, want %d %q", i, rec.uint(2), rec.string(3), want.severityNumber, want.severityText)
+		}
+		if rec.uint(1) == 0 || rec.uint(11) == 0 {
+			t.Errorf("record %d has no time or observed time", i)
+		}
+		if !bytes.Equal(rec[9][0].([]byte), traceId) || !bytes.Equal(rec[10][0].([]byte), spanId) {
+			t.Errorf("record %d is linked to %x/%x, want the span of the attempt %x/%x", i, rec[9][0], rec[10][0], traceId, spanId)
+		}
+	}
+}
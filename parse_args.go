@@ -3,44 +3,394 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"rex-hive-daemon/cpu_affinity"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/redact"
 	"rex-hive-daemon/rexregexp"
+	"rex-hive-daemon/slice_tools"
+	"sort"
 	"strconv"
 )
 
 var getUniqueInSequenceRegex = regexp.MustCompile(`{unique-in-sequence:(?P<from>\d+)-(?P<to>\d+)}`)
 
-func getDynamicArgsOrPanic(originalArgs *[]string, used *map[int]bool) []string {
+// Matches any form of the placeholder, eg: the unsupported `{unique-in-sequence:8000-}`
+var anyUniqueInSequenceRegex = regexp.MustCompile(`{unique-in-sequence[^}]*}`)
 
-	replacedArgs := make([]string, len(*originalArgs))
-	copy(replacedArgs, *originalArgs)
+// AllocationError describes a dynamic argument that could not be allocated a value for a given replica.
+type AllocationError struct {
+	Process     string
+	Replica     int
+	Placeholder string
+	Reason      string
+}
+
+func (e *AllocationError) Error() string {
+	return fmt.Sprintf("process '%s', replica %d: cannot allocate %s: %s", e.Process, e.Replica, e.Placeholder, e.Reason)
+}
+
+// sequenceRange is the inclusive range of numbers a `{unique-in-sequence:from-to}` placeholder can take.
+type sequenceRange struct {
+	from int
+	to   int
+}
+
+func (r sequenceRange) size() int {
+	return r.to - r.from + 1
+}
+
+// parseSequenceRanges returns the range of every placeholder contained in arg, in order. Fails if a placeholder isn't a
+// `{unique-in-sequence:from-to}` range.
+func parseSequenceRanges(arg string) ([]sequenceRange, error) {
+	var ranges []sequenceRange
+	for _, placeholder := range anyUniqueInSequenceRegex.FindAllString(arg, -1) {
+		if getUniqueInSequenceRegex.FindString(placeholder) != placeholder {
+			return nil, fmt.Errorf("%s: only closed ranges are supported, eg: {unique-in-sequence:8000-8099}", placeholder)
+		}
+		matches := rexregexp.MatchNamedCapturingGroups(&placeholder, getUniqueInSequenceRegex)
+		from, err := strconv.Atoi(matches["from"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid range start: %w", placeholder, err)
+		}
+		to, err := strconv.Atoi(matches["to"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid range end: %w", placeholder, err)
+		}
+
+		// Swap is from is greater than to
+		if from > to {
+			from, to = to, from
+		}
+		ranges = append(ranges, sequenceRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+// replicaPlan is the fully expanded command of a single replica. All plans are computed before any process is spawned
+// so a spec that cannot be satisfied never starts half of its processes.
+type replicaPlan struct {
+	// index is the global index of the replica across all the process specs.
+	index int
+	// replica is the index of the replica within its process spec.
+	replica int
+	spec    *hive_spec.ProcessSpec
+	args    []string
+	// redactor masks the sensitive args and env values of the replica, and the redact patterns of its spec.
+	redactor *redact.Redactor
+	// credential is the user and groups the replica runs as, nil to run as the daemon's.
+	credential *processCredential
+	// cpus the replica is pinned to, empty to run on any CPU.
+	cpus []int
+}
+
+// displayArgs returns the args with the sensitive ones masked, to be printed.
+func (plan *replicaPlan) displayArgs() []string {
+	display := make([]string, len(plan.args))
+	for i, arg := range plan.args {
+		if plan.spec.Cmd[i+1].Sensitive {
+			arg = redact.Mask(arg)
+		}
+		display[i] = arg
+	}
+	return display
+}
+
+// displayEnvValue returns the value of the env entry at the given index, masked if it's sensitive.
+func (plan *replicaPlan) displayEnvValue(i int) string {
+	if plan.spec.Env[i].Sensitive {
+		return redact.Mask(plan.spec.Env[i].Value)
+	}
+	return plan.spec.Env[i].Value
+}
+
+// planHiveSpec allocates the dynamic args of every replica in the spec. Either all replicas get their args or an error
+// is returned and nothing is allocated.
+func planHiveSpec(hiveSpec *hive_spec.HiveSpec) ([]*replicaPlan, error) {
+	if err := checkSequenceCapacity(hiveSpec.Spec.Processes); err != nil {
+		return nil, err
+	}
+
+	cpus, err := newCpuAllocator(hiveSpec.Spec.Processes)
+	if err != nil {
+		return nil, err
+	}
+
+	sequences := allocateSequences(hiveSpec.Spec.Processes)
+	var plans []*replicaPlan
+	for _, s := range hiveSpec.Spec.Processes {
+		if len(s.Cmd) < 1 {
+			return nil, fmt.Errorf("process '%s' has an empty cmd", s.Name)
+		}
+		if err := checkWorkingDir(s); err != nil {
+			return nil, err
+		}
+		credential, err := resolveCredential(s)
+		if err != nil {
+			return nil, err
+		}
+		for rep := 0; rep < s.Replicas; rep++ {
+			args, err := getDynamicArgs(s, rep, sequences)
+			if err != nil {
+				return nil, err
+			}
+			replicaCpus, err := cpus.allocate(s, rep)
+			if err != nil {
+				return nil, err
+			}
+			plans = append(plans, &replicaPlan{
+				index:      len(plans),
+				replica:    rep,
+				spec:       s,
+				args:       args,
+				redactor:   newReplicaRedactor(s, args),
+				credential: credential,
+				cpus:       replicaCpus,
+			})
+		}
+	}
+	return plans, nil
+}
+
+// checkSequenceCapacity verifies that the placeholders are `{unique-in-sequence:from-to}` ranges and that, for every
+// span of numbers, the placeholders whose ranges fall within it fit in it. Values are unique across all ranges, so
+// overlapping ranges compete for the same numbers.
+func checkSequenceCapacity(processes []*hive_spec.ProcessSpec) error {
+	var ranges []sequenceRange
+	demand := map[sequenceRange]int{}
+	for _, s := range processes {
+		if len(s.Cmd) < 1 {
+			continue
+		}
+		for rep := 0; rep < s.Replicas; rep++ {
+			for _, arg := range s.Cmd[1:] {
+				argRanges, err := parseSequenceRanges(arg.Value)
+				if err != nil {
+					return &AllocationError{Process: s.Name, Replica: rep, Placeholder: arg.Value, Reason: err.Error()}
+				}
+				for _, r := range argRanges {
+					if demand[r] == 0 {
+						ranges = append(ranges, r)
+					}
+					demand[r]++
+					if span, required, ok := exceededSpan(ranges, demand, r); ok {
+						return &AllocationError{
+							Process:     s.Name,
+							Replica:     rep,
+							Placeholder: arg.Value,
+							Reason:      fmt.Sprintf("range %d-%d has %d values but %d are required by the processes sharing it", span.from, span.to, span.size(), required),
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// exceededSpan returns a span around r with more placeholders whose ranges fall within it than numbers, if any. Only the
+// spans around r might have just been exceeded.
+func exceededSpan(ranges []sequenceRange, demand map[sequenceRange]int, r sequenceRange) (sequenceRange, int, bool) {
+	for _, a := range ranges {
+		for _, b := range ranges {
+			span := sequenceRange{from: minInt(a.from, r.from), to: maxInt(b.to, r.to)}
+			required := 0
+			for _, c := range ranges {
+				if c.from >= span.from && c.to <= span.to {
+					required += demand[c]
+				}
+			}
+			if required > span.size() {
+				return span, required, true
+			}
+		}
+	}
+	return sequenceRange{}, 0, false
+}
 
-	for i, arg := range *originalArgs {
-		matches := rexregexp.MatchNamedCapturingGroups(&arg, getUniqueInSequenceRegex)
-		if len(matches["from"]) > 0 && len(matches["to"]) > 0 {
-			from, _ := strconv.Atoi(matches["from"])
-			to, _ := strconv.Atoi(matches["to"])
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
 
-			// Swap is from is greater than to
-			if from > to {
-				oldTo := to
-				to = from
-				from = oldTo
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// cpuAllocator hands out disjoint sets of CPUs to the replicas with `cpuAffinity: {auto: n}`, preferring CPUs of the
+// same NUMA node. CPUs listed explicitly by any process are never handed out.
+type cpuAllocator struct {
+	available []int
+	nodes     map[int]int
+	used      map[int]bool
+}
+
+func newCpuAllocator(processes []*hive_spec.ProcessSpec) (*cpuAllocator, error) {
+	a := &cpuAllocator{used: map[int]bool{}}
+	for _, s := range processes {
+		if s.CpuAffinity == nil {
+			continue
+		}
+		if a.available == nil {
+			available, err := cpu_affinity.Available()
+			if err != nil {
+				return nil, fmt.Errorf("process '%s': cannot get the available CPUs: %w", s.Name, err)
+			}
+			a.available = available
+			a.nodes = cpu_affinity.Nodes()
+		}
+		for _, c := range s.CpuAffinity.Cpus {
+			if slice_tools.FindIndex(&a.available, func(v int) bool { return v == c }) < 0 {
+				return nil, fmt.Errorf("process '%s': CPU %d is not available to the daemon, available CPUs: %s", s.Name, c, cpu_affinity.FormatList(a.available))
 			}
+			a.used[c] = true
+		}
+	}
+	return a, nil
+}
+
+// allocate returns the CPUs the replica is pinned to.
+func (a *cpuAllocator) allocate(processSpec *hive_spec.ProcessSpec, replica int) ([]int, error) {
+	affinity := processSpec.CpuAffinity
+	if affinity == nil {
+		return nil, nil
+	}
+	if affinity.Auto <= 0 {
+		return affinity.Cpus, nil
+	}
+
+	// Free CPUs by node, in order of node
+	var free []int
+	byNode := map[int][]int{}
+	var nodeOrder []int
+	for _, c := range a.available {
+		if a.used[c] {
+			continue
+		}
+		free = append(free, c)
+		node := a.nodes[c]
+		if _, ok := byNode[node]; !ok {
+			nodeOrder = append(nodeOrder, node)
+		}
+		byNode[node] = append(byNode[node], c)
+	}
+	if len(free) < affinity.Auto {
+		return nil, &AllocationError{
+			Process:     processSpec.Name,
+			Replica:     replica,
+			Placeholder: fmt.Sprintf("cpuAffinity auto: %d", affinity.Auto),
+			Reason:      fmt.Sprintf("only %d of the %d available CPUs are free", len(free), len(a.available)),
+		}
+	}
 
-			didAssign := false
-			for seq := from; seq <= to; seq++ {
-				if !(*used)[seq] {
-					replacedArgs[i] = getUniqueInSequenceRegex.ReplaceAllString(arg, strconv.Itoa(seq))
-					(*used)[seq] = true
-					didAssign = true
-					break
+	// Spread across nodes only when no single node has enough free CPUs
+	cpus := free[:affinity.Auto]
+	for _, node := range nodeOrder {
+		if len(byNode[node]) >= affinity.Auto {
+			cpus = byNode[node][:affinity.Auto]
+			break
+		}
+	}
+	for _, c := range cpus {
+		a.used[c] = true
+	}
+	return append([]int(nil), cpus...), nil
+}
+
+// sequenceSlot is a `{unique-in-sequence}` placeholder of an arg of a replica.
+type sequenceSlot struct {
+	process *hive_spec.ProcessSpec
+	replica int
+	arg     int
+	// match is the index of the placeholder within the arg
+	match int
+}
+
+// allocateSequences picks the value of every `{unique-in-sequence}` placeholder. The placeholders whose range ends first
+// pick first, the lowest value left in their range, so all of them get a value whenever checkSequenceCapacity passes.
+// Placeholders left out are missing from the result.
+func allocateSequences(processes []*hive_spec.ProcessSpec) map[sequenceSlot]int {
+	var slots []sequenceSlot
+	ranges := map[sequenceSlot]sequenceRange{}
+	for _, s := range processes {
+		if len(s.Cmd) < 1 {
+			continue
+		}
+		for rep := 0; rep < s.Replicas; rep++ {
+			for i, arg := range s.Cmd[1:] {
+				// Invalid placeholders are reported by checkSequenceCapacity
+				argRanges, _ := parseSequenceRanges(arg.Value)
+				for j, r := range argRanges {
+					slot := sequenceSlot{process: s, replica: rep, arg: i, match: j}
+					slots = append(slots, slot)
+					ranges[slot] = r
 				}
 			}
-			if !didAssign {
-				panic(fmt.Sprintf("dynamic argument %s cannot be allocated a value, all values in the sequense have been reserved", arg))
+		}
+	}
+	// Stable, so placeholders of the same range get increasing values in the order of the spec
+	sort.SliceStable(slots, func(a, b int) bool { return ranges[slots[a]].to < ranges[slots[b]].to })
+
+	used := map[int]bool{}
+	values := map[sequenceSlot]int{}
+	for _, slot := range slots {
+		r := ranges[slot]
+		for seq := r.from; seq <= r.to; seq++ {
+			if !used[seq] {
+				used[seq] = true
+				values[slot] = seq
+				break
+			}
+		}
+	}
+	return values
+}
+
+func getDynamicArgs(processSpec *hive_spec.ProcessSpec, replica int, sequences map[sequenceSlot]int) ([]string, error) {
+	originalArgs := processSpec.Cmd[1:]
+	replacedArgs := make([]string, len(originalArgs))
+	for i, arg := range originalArgs {
+		replacedArgs[i] = arg.Value
+	}
+
+	for i, arg := range replacedArgs {
+		var err error
+		match := 0
+		replacedArgs[i] = getUniqueInSequenceRegex.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			seq, ok := sequences[sequenceSlot{process: processSpec, replica: replica, arg: i, match: match}]
+			match++
+			if !ok && err == nil {
+				err = &AllocationError{
+					Process:     processSpec.Name,
+					Replica:     replica,
+					Placeholder: placeholder,
+					Reason:      "all values in the sequence have been reserved",
+				}
 			}
+			return strconv.Itoa(seq)
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return replacedArgs
+	return replacedArgs, nil
+}
+
+func newReplicaRedactor(processSpec *hive_spec.ProcessSpec, args []string) *redact.Redactor {
+	sensitive := processSpec.SensitiveEnvValues()
+	for i, arg := range args {
+		if processSpec.Cmd[i+1].Sensitive {
+			sensitive = append(sensitive, arg)
+		}
+	}
+	var patterns []*regexp.Regexp
+	for _, r := range processSpec.Redact {
+		patterns = append(patterns, r.Regex)
+	}
+	return redact.New(patterns, sensitive)
 }
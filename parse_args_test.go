@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"rex-hive-daemon/hive_spec"
+	"strings"
+	"testing"
+)
+
+func newProcess(name string, replicas int, args ...string) *hive_spec.ProcessSpec {
+	cmd := []hive_spec.CmdArg{{Value: "server"}}
+	for _, a := range args {
+		cmd = append(cmd, hive_spec.CmdArg{Value: a})
+	}
+	return &hive_spec.ProcessSpec{Name: name, Replicas: replicas, Cmd: cmd}
+}
+
+func TestParseSequenceRanges(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    []sequenceRange
+		wantErr string
+	}{
+		{"--port=8000", nil, ""},
+		{"--port={unique-in-sequence:8000-8009}", []sequenceRange{{8000, 8009}}, ""},
+		{"{unique-in-sequence:9-1}", []sequenceRange{{1, 9}}, ""},
+		{"--p={unique-in-sequence:1-2},{unique-in-sequence:5-6}", []sequenceRange{{1, 2}, {5, 6}}, ""},
+		{"{unique-in-sequence:8000-}", nil, "only closed ranges"},
+		{"{unique-in-sequence:8000-8099:2}", nil, "only closed ranges"},
+		{"{unique-in-sequence:1-2},{unique-in-sequence}", nil, "only closed ranges"},
+		{"{unique-in-sequence:1-99999999999999999999}", nil, "invalid range end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, err := parseSequenceRanges(tt.arg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSequenceRanges() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSequenceRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSequenceCapacity(t *testing.T) {
+	tests := []struct {
+		name      string
+		processes []*hive_spec.ProcessSpec
+		wantErr   string
+	}{
+		{"fits", []*hive_spec.ProcessSpec{
+			newProcess("a", 3, "{unique-in-sequence:1-3}"),
+		}, ""},
+		{"shared range exceeded", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "{unique-in-sequence:1-3}"),
+			newProcess("b", 2, "{unique-in-sequence:1-3}"),
+		}, "process 'b', replica 1: cannot allocate {unique-in-sequence:1-3}: range 1-3 has 3 values but 4 are required"},
+		{"overlapping ranges fit", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "{unique-in-sequence:1-3}"),
+			newProcess("b", 2, "{unique-in-sequence:2-4}"),
+		}, ""},
+		{"overlapping ranges exceeded", []*hive_spec.ProcessSpec{
+			newProcess("a", 3, "{unique-in-sequence:1-3}"),
+			newProcess("b", 2, "{unique-in-sequence:2-4}"),
+		}, "range 1-4 has 4 values but 5 are required"},
+		{"several placeholders in an arg", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "--p={unique-in-sequence:1-2},{unique-in-sequence:1-2}"),
+		}, "range 1-2 has 2 values but 3 are required"},
+		{"open range", []*hive_spec.ProcessSpec{
+			newProcess("a", 1, "{unique-in-sequence:8000-}"),
+		}, "only closed ranges"},
+		{"overflowing bound", []*hive_spec.ProcessSpec{
+			newProcess("a", 1, "{unique-in-sequence:99999999999999999999-1}"),
+		}, "invalid range start"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSequenceCapacity(tt.processes)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkSequenceCapacity() = %v", err)
+				}
+				return
+			}
+			var allocationErr *AllocationError
+			if !errors.As(err, &allocationErr) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkSequenceCapacity() = %v, want an AllocationError with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllocateSequences(t *testing.T) {
+	tests := []struct {
+		name      string
+		processes []*hive_spec.ProcessSpec
+		// Args of every replica, in order
+		want [][]string
+	}{
+		{"same range in the order of the spec", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "--port={unique-in-sequence:8000-8009}"),
+			newProcess("b", 1, "--port={unique-in-sequence:8000-8009}", "static"),
+		}, [][]string{{"--port=8000"}, {"--port=8001"}, {"--port=8002", "static"}}},
+		{"ranges ending first pick first", []*hive_spec.ProcessSpec{
+			newProcess("a", 1, "{unique-in-sequence:1-4}"),
+			newProcess("b", 1, "{unique-in-sequence:1-1}"),
+		}, [][]string{{"2"}, {"1"}}},
+		{"each placeholder of an arg gets its own value", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "--p={unique-in-sequence:1-2},{unique-in-sequence:5-6}"),
+		}, [][]string{{"--p=1,5"}, {"--p=2,6"}}},
+		{"placeholders of an arg sharing a range", []*hive_spec.ProcessSpec{
+			newProcess("a", 2, "{unique-in-sequence:1-4}-{unique-in-sequence:1-4}"),
+		}, [][]string{{"1-2"}, {"3-4"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSequenceCapacity(tt.processes); err != nil {
+				t.Fatal(err)
+			}
+			sequences := allocateSequences(tt.processes)
+			var got [][]string
+			for _, s := range tt.processes {
+				for rep := 0; rep < s.Replicas; rep++ {
+					args, err := getDynamicArgs(s, rep, sequences)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, args)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDynamicArgsUnallocated(t *testing.T) {
+	s := newProcess("a", 2, "{unique-in-sequence:1-1}")
+	// Without checking the capacity first, the second replica is left without a value
+	sequences := allocateSequences([]*hive_spec.ProcessSpec{s})
+	if _, err := getDynamicArgs(s, 1, sequences); err == nil {
+		t.Fatal("getDynamicArgs() of an unallocated placeholder succeeded")
+	}
+}
@@ -0,0 +1,33 @@
+package proc_metrics
+
+import "time"
+
+// Metrics is a sample of the resource usage of a process. It doesn't include the usage of its children.
+type Metrics struct {
+	// CpuPercent is the CPU time used since the previous sample over the elapsed time, 100 per fully used CPU.
+	CpuPercent float64 `bson:"cpuPercent" json:"cpuPercent"`
+	// CpuSeconds is the total CPU time used since the process started.
+	CpuSeconds float64 `bson:"cpuSeconds" json:"cpuSeconds"`
+	RssBytes   int64   `bson:"rssBytes" json:"rssBytes"`
+	Threads    int     `bson:"threads" json:"threads"`
+	OpenFds    int     `bson:"openFds" json:"openFds"`
+	// ReadBytes and WriteBytes are the total bytes the process read from and wrote to storage since it started.
+	ReadBytes  int64 `bson:"readBytes" json:"readBytes"`
+	WriteBytes int64 `bson:"writeBytes" json:"writeBytes"`
+}
+
+// Sampler samples the resource usage of a process, keeping the CPU time of the previous sample to compute the CPU
+// percent.
+type Sampler struct {
+	pid         int
+	lastCpuTime time.Duration
+	lastTime    time.Time
+}
+
+func NewSampler(pid int) *Sampler {
+	s := &Sampler{pid: pid, lastTime: time.Now()}
+	if cpuTime, err := readCpuTime(pid); err == nil {
+		s.lastCpuTime = cpuTime
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package proc_metrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock ticks per second of the CPU times in /proc, USER_HZ is 100 in every architecture supported by Go.
+const clockTicksPerSecond = 100
+
+// Sample reads the resource usage of the process from /proc.
+func (s *Sampler) Sample() (*Metrics, error) {
+	stat, err := readStat(s.pid)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{}
+
+	cpuTime := cpuTimeOf(stat)
+	m.CpuSeconds = cpuTime.Seconds()
+	now := time.Now()
+	if elapsed := now.Sub(s.lastTime); elapsed > 0 {
+		m.CpuPercent = float64(cpuTime-s.lastCpuTime) / float64(elapsed) * 100
+	}
+	s.lastCpuTime, s.lastTime = cpuTime, now
+
+	m.Threads, _ = strconv.Atoi(stat[20])
+	rssPages, _ := strconv.ParseInt(stat[24], 10, 64)
+	m.RssBytes = rssPages * int64(os.Getpagesize())
+
+	if fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", s.pid)); err == nil {
+		m.OpenFds = len(fds)
+	}
+
+	// Only readable by the same user or with CAP_SYS_PTRACE
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/io", s.pid)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			name, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch name {
+			case "read_bytes":
+				m.ReadBytes, _ = strconv.ParseInt(value, 10, 64)
+			case "write_bytes":
+				m.WriteBytes, _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		_ = f.Close()
+	}
+	return m, nil
+}
+
+func readCpuTime(pid int) (time.Duration, error) {
+	stat, err := readStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return cpuTimeOf(stat), nil
+}
+
+// cpuTimeOf returns the user plus system CPU time of the stat fields.
+func cpuTimeOf(stat []string) time.Duration {
+	utime, _ := strconv.ParseInt(stat[14], 10, 64)
+	stime, _ := strconv.ParseInt(stat[15], 10, 64)
+	return time.Duration(utime+stime) * time.Second / clockTicksPerSecond
+}
+
+// readStat returns the fields of /proc/<pid>/stat, indexed as in proc(5), so the PID is at index 1.
+func readStat(pid int) ([]string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is between parentheses and can contain spaces and parentheses itself
+	s := string(b)
+	end := strings.LastIndexByte(s, ')')
+	start := strings.IndexByte(s, '(')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := append([]string{"", strings.TrimSpace(s[:start]), s[start+1 : end]}, strings.Fields(s[end+1:])...)
+	if len(fields) < 25 {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
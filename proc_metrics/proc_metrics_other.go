@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proc_metrics
+
+import (
+	"errors"
+	"time"
+)
+
+var errNotSupported = errors.New("process metrics are only supported on linux")
+
+func (s *Sampler) Sample() (*Metrics, error) {
+	return nil, errNotSupported
+}
+
+func readCpuTime(pid int) (time.Duration, error) {
+	return 0, errNotSupported
+}
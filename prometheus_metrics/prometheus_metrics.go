@@ -0,0 +1,258 @@
+package prometheus_metrics
+
+import (
+	"fmt"
+	"net/http"
+	"rex-hive-daemon/proc_metrics"
+	"rex-hive-daemon/rexprint"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateRunning = "running"
+	// StateBackoff is a replica waiting to be re-run.
+	StateBackoff = "backoff"
+	// StateStopped is a replica that exited and won't be re-run.
+	StateStopped = "stopped"
+)
+
+type replica struct {
+	name         string
+	index        int
+	state        string
+	pid          int
+	startedAt    time.Time
+	lastExitCode int
+	exited       bool
+	backoffDelay time.Duration
+}
+
+// sinkStats are the stats of writing the messages to a sink.
+type sinkStats struct {
+	holdingMessages  int
+	writes           int
+	writeFailures    int
+	writeSecondsSum  float64
+	lastWriteSeconds float64
+}
+
+var (
+	replicas = map[int]*replica{}
+	restarts = map[string]int{}
+	sinks    = map[string]*sinkStats{}
+	// Locks reads and writes to all the metrics.
+	lock sync.Mutex
+)
+
+func getReplica(index int, name string) *replica {
+	r, ok := replicas[index]
+	if !ok {
+		r = &replica{name: name, index: index}
+		replicas[index] = r
+	}
+	return r
+}
+
+// ReplicaStarted records a started attempt of the replica. Attempts after the first count as restarts of the process.
+func ReplicaStarted(index int, name string, pid int, attempt int) {
+	lock.Lock()
+	defer lock.Unlock()
+	r := getReplica(index, name)
+	r.state, r.pid, r.startedAt, r.backoffDelay = StateRunning, pid, time.Now(), 0
+	if attempt > 0 {
+		restarts[name]++
+	}
+}
+
+// ReplicaExited records the exit code of the replica, which is stopped until it's set to back off.
+func ReplicaExited(index int, name string, exitCode int) {
+	lock.Lock()
+	defer lock.Unlock()
+	r := getReplica(index, name)
+	r.state, r.pid, r.lastExitCode, r.exited = StateStopped, 0, exitCode, true
+}
+
+// ReplicaBackoff records that the replica waits delay to be re-run.
+func ReplicaBackoff(index int, name string, delay time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	r := getReplica(index, name)
+	r.state, r.backoffDelay = StateBackoff, delay
+}
+
+func getSink(name string) *sinkStats {
+	s, ok := sinks[name]
+	if !ok {
+		s = &sinkStats{}
+		sinks[name] = s
+	}
+	return s
+}
+
+// SetHoldingMessages sets the amount of messages waiting to be written to the sink.
+func SetHoldingMessages(sink string, n int) {
+	lock.Lock()
+	getSink(sink).holdingMessages = n
+	lock.Unlock()
+}
+
+// ObserveFlush records an attempt to write a batch of messages to the sink.
+func ObserveFlush(sink string, duration time.Duration, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	s := getSink(sink)
+	s.writes++
+	s.writeSecondsSum += duration.Seconds()
+	s.lastWriteSeconds = duration.Seconds()
+	if err != nil {
+		s.writeFailures++
+	}
+}
+
+// Run serves the metrics in the Prometheus text format at `http://<addr>/metrics`. It blocks until the listener
+// fails.
+func Run(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	rexprint.Println(rexprint.Dim(fmt.Sprintf("metrics listening on %s", addr)))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		rexprint.Println(rexprint.ErrColor(fmt.Sprintf("metrics stopped: %s", err)))
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(Expose()))
+}
+
+// Expose returns all the metrics in the Prometheus text format.
+func Expose() string {
+	lock.Lock()
+	sorted := make([]replica, 0, len(replicas))
+	for _, r := range replicas {
+		sorted = append(sorted, *r)
+	}
+	restartsCopy := map[string]int{}
+	for k, v := range restarts {
+		restartsCopy[k] = v
+	}
+	sinksCopy := map[string]sinkStats{}
+	var sinkNames []string
+	for name, s := range sinks {
+		sinksCopy[name] = *s
+		sinkNames = append(sinkNames, name)
+	}
+	lock.Unlock()
+	sort.Strings(sinkNames)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].index < sorted[j].index })
+
+	var sb strings.Builder
+	now := time.Now()
+
+	header(&sb, "rex_replicas", "gauge", "Replicas by state.")
+	byState := map[string]int{StateRunning: 0, StateBackoff: 0, StateStopped: 0}
+	for _, r := range sorted {
+		byState[r.state]++
+	}
+	for _, state := range []string{StateRunning, StateBackoff, StateStopped} {
+		sample(&sb, "rex_replicas", labels("state", state), float64(byState[state]))
+	}
+
+	header(&sb, "rex_restarts_total", "counter", "Restarts of the replicas of the process.")
+	var names []string
+	for name := range restartsCopy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sample(&sb, "rex_restarts_total", labels("process", name), float64(restartsCopy[name]))
+	}
+
+	header(&sb, "rex_replica_last_exit_code", "gauge", "Exit code of the last attempt of the replica, -1 when killed by a signal or it couldn't start.")
+	for _, r := range sorted {
+		if r.exited {
+			sample(&sb, "rex_replica_last_exit_code", replicaLabels(r), float64(r.lastExitCode))
+		}
+	}
+
+	header(&sb, "rex_replica_backoff_seconds", "gauge", "Delay before re-running the replica, 0 when it's not backing off.")
+	for _, r := range sorted {
+		sample(&sb, "rex_replica_backoff_seconds", replicaLabels(r), r.backoffDelay.Seconds())
+	}
+
+	header(&sb, "rex_replica_uptime_seconds", "gauge", "Time since the current attempt of the replica started.")
+	for _, r := range sorted {
+		if r.state == StateRunning {
+			sample(&sb, "rex_replica_uptime_seconds", replicaLabels(r), now.Sub(r.startedAt).Seconds())
+		}
+	}
+
+	// Read from /proc on each scrape
+	usages := map[int]*proc_metrics.Metrics{}
+	for _, r := range sorted {
+		if r.state != StateRunning {
+			continue
+		}
+		if m, err := proc_metrics.NewSampler(r.pid).Sample(); err == nil {
+			usages[r.index] = m
+		}
+	}
+	header(&sb, "rex_replica_cpu_seconds_total", "counter", "CPU time used by the current attempt of the replica.")
+	for _, r := range sorted {
+		if m, ok := usages[r.index]; ok {
+			sample(&sb, "rex_replica_cpu_seconds_total", replicaLabels(r), m.CpuSeconds)
+		}
+	}
+	header(&sb, "rex_replica_rss_bytes", "gauge", "Resident memory of the current attempt of the replica.")
+	for _, r := range sorted {
+		if m, ok := usages[r.index]; ok {
+			sample(&sb, "rex_replica_rss_bytes", replicaLabels(r), float64(m.RssBytes))
+		}
+	}
+
+	header(&sb, "rex_sink_holding_messages", "gauge", "Messages waiting to be written to the sink.")
+	for _, name := range sinkNames {
+		sample(&sb, "rex_sink_holding_messages", labels("sink", name), float64(sinksCopy[name].holdingMessages))
+	}
+	header(&sb, "rex_sink_write_failures_total", "counter", "Failed attempts to write a batch of messages to the sink.")
+	for _, name := range sinkNames {
+		sample(&sb, "rex_sink_write_failures_total", labels("sink", name), float64(sinksCopy[name].writeFailures))
+	}
+	header(&sb, "rex_sink_write_duration_seconds", "summary", "Duration of the attempts to write a batch of messages to the sink.")
+	for _, name := range sinkNames {
+		sample(&sb, "rex_sink_write_duration_seconds_sum", labels("sink", name), sinksCopy[name].writeSecondsSum)
+		sample(&sb, "rex_sink_write_duration_seconds_count", labels("sink", name), float64(sinksCopy[name].writes))
+	}
+	header(&sb, "rex_sink_last_write_duration_seconds", "gauge", "Duration of the last attempt to write a batch of messages to the sink.")
+	for _, name := range sinkNames {
+		sample(&sb, "rex_sink_last_write_duration_seconds", labels("sink", name), sinksCopy[name].lastWriteSeconds)
+	}
+
+	return sb.String()
+}
+
+func header(sb *strings.Builder, name string, metricType string, help string) {
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType))
+}
+
+func sample(sb *strings.Builder, name string, labels string, value float64) {
+	sb.WriteString(fmt.Sprintf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'f', -1, 64)))
+}
+
+func replicaLabels(r replica) string {
+	return labels("process", r.name, "index", fmt.Sprint(r.index))
+}
+
+// labels formats label pairs, eg: `{process="game",index="0"}`.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
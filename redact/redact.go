@@ -0,0 +1,111 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// maskKey is the HMAC key of the masks. It's read from REX_REDACT_KEY so masks can be correlated across daemons and
+// runs, otherwise it's random and masks can only be correlated within the same run.
+var maskKey = getMaskKey()
+
+func getMaskKey() []byte {
+	if k := os.Getenv("REX_REDACT_KEY"); k != "" {
+		return []byte(k)
+	}
+	k := make([]byte, 32)
+	_, _ = rand.Read(k)
+	return k
+}
+
+// Mask returns a replacement for a sensitive value. Equal values get equal masks, so they can still be correlated, but
+// the value cannot be recovered from its mask. Eg: `[redacted:3f9a1c2b]`.
+func Mask(value string) string {
+	h := hmac.New(sha256.New, maskKey)
+	_, _ = h.Write([]byte(value))
+	return "[redacted:" + hex.EncodeToString(h.Sum(nil))[:8] + "]"
+}
+
+// Literal values shorter than this are not masked in lines of text, masking every `1` or `on` would make the output
+// unreadable without protecting anything.
+const minValueLength = 4
+
+// Redactor masks sensitive values in lines of text.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// New returns a redactor masking the given literal values and the matches of the patterns. Of the patterns with
+// capturing groups only the groups are masked, otherwise the whole match is. Returns nil, a no-op redactor, if there's
+// nothing to redact.
+func New(patterns []*regexp.Regexp, values []string) *Redactor {
+	var longEnough []string
+	for _, v := range values {
+		if len(v) >= minValueLength {
+			longEnough = append(longEnough, v)
+		}
+	}
+	if len(patterns) <= 0 && len(longEnough) <= 0 {
+		return nil
+	}
+	return &Redactor{patterns: patterns, values: longEnough}
+}
+
+// With returns a redactor also masking the given literal values. r can be nil.
+func (r *Redactor) With(values []string) *Redactor {
+	if r == nil {
+		return New(nil, values)
+	}
+	return New(r.patterns, append(append([]string{}, r.values...), values...))
+}
+
+// Redact returns the line with all the sensitive values masked.
+func (r *Redactor) Redact(line string) string {
+	if r == nil {
+		return line
+	}
+	for _, v := range r.values {
+		if strings.Contains(line, v) {
+			line = strings.ReplaceAll(line, v, Mask(v))
+		}
+	}
+	for _, re := range r.patterns {
+		line = redactPattern(line, re)
+	}
+	return line
+}
+
+func redactPattern(line string, re *regexp.Regexp) string {
+	matches := re.FindAllStringSubmatchIndex(line, -1)
+	if len(matches) <= 0 {
+		return line
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		// m holds the start and end of the whole match, followed by the start and end of each group
+		spans := m[:2]
+		if len(m) > 2 {
+			spans = m[2:]
+		}
+		for j := 0; j+1 < len(spans); j += 2 {
+			start, end := spans[j], spans[j+1]
+			// Skip groups that didn't participate in the match, or overlap a previous group
+			if start < 0 || start < last {
+				continue
+			}
+			b.WriteString(line[last:start])
+			b.WriteString(Mask(line[start:end]))
+			last = end
+		}
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/log_rotation"
+	"sort"
+	"time"
+)
+import p "rex-hive-daemon/rexprint"
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+var attemptLog = regexp.MustCompile(`^[0-9]+\.log$`)
+
+// openReplicaLog opens the log file of the replica, or of a single attempt of it when attempt is not negative. Returns
+// nil if the process spec has no logs or the file cannot be opened.
+func openReplicaLog(processSpec *hive_spec.ProcessSpec, i int, attempt int) *log_rotation.File {
+	logs := processSpec.Logs
+	if logs == nil {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%d", unsafeFileNameChars.ReplaceAllString(processSpec.Name, "_"), i)
+	maxSizeMB := hive_spec.DefaultLogsMaxSizeMB
+	if logs.MaxSizeMB > 0 {
+		maxSizeMB = logs.MaxSizeMB
+	}
+	maxFiles := hive_spec.DefaultLogsMaxFiles
+	if logs.MaxFiles > 0 {
+		maxFiles = logs.MaxFiles
+	}
+
+	source := p.Source{Name: processSpec.Name, Index: i, Pid: invalidPid, Attempt: attempt}
+	path := filepath.Join(logs.Dir, name+".log")
+	if attempt >= 0 {
+		// A directory per replica, so pruning can't match the files of another process
+		path = filepath.Join(logs.Dir, name, fmt.Sprintf("%d.log", attempt))
+		if err := prunePerAttemptLogs(path, maxFiles); err != nil {
+			p.PrintLnColor(source, p.ErrColor(fmt.Sprintf("cannot prune the log files of previous attempts: %s", err)))
+		}
+	}
+
+	f, err := log_rotation.Open(path, int64(maxSizeMB)*1024*1024, maxFiles, logs.Compress)
+	if err != nil {
+		p.PrintLnColor(source, p.ErrColor(fmt.Sprintf("cannot open log file: %s", err)))
+		return nil
+	}
+	return f
+}
+
+// prunePerAttemptLogs removes the log files of the previous attempts of the replica that logs to path, along with
+// their rotated files, except for the most recent maxFiles. Eg: `web-0/12.log` for `web-0/13.log`.
+func prunePerAttemptLogs(path string, maxFiles int) error {
+	dir, base := filepath.Split(path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	type attemptFile struct {
+		name    string
+		modTime time.Time
+	}
+	var previous []attemptFile
+	for _, e := range entries {
+		if e.Name() == base || !attemptLog.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		previous = append(previous, attemptFile{e.Name(), info.ModTime()})
+	}
+	if len(previous) <= maxFiles {
+		return nil
+	}
+
+	sort.Slice(previous, func(a, b int) bool { return previous[a].modTime.After(previous[b].modTime) })
+	for _, f := range previous[maxFiles:] {
+		rotated, _ := filepath.Glob(filepath.Join(dir, f.name) + ".*")
+		for _, name := range append(rotated, filepath.Join(dir, f.name)) {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeReplicaLog writes a timestamped line to the log file, if not nil.
+func writeReplicaLog(f *log_rotation.File, stream string, pid int, attempt int, line string) {
+	if f == nil {
+		return
+	}
+	// Errors are ignored, the output is still printed and stored in DB
+	_, _ = fmt.Fprintf(f, "%s %s %d:%d %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"), stream, pid, attempt, line)
+}
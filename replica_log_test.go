@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPrunePerAttemptLogs(t *testing.T) {
+	dir := t.TempDir()
+	// Attempts 1 to 4 of web-0, oldest first, and files of other replicas and processes
+	files := []string{
+		"web-0/1.log", "web-0/1.log.1.gz", "web-0/2.log", "web-0/3.log", "web-0/3.log.1", "web-0/4.log",
+		"web-0/notes.txt", "web-0-1/1.log", "web-0.log",
+	}
+	modTime := time.Now().Add(-time.Hour)
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Attempt 5 keeps the files of the 2 most recent previous attempts
+	if err := prunePerAttemptLogs(filepath.Join(dir, "web-0", "5.log"), 2); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	sort.Strings(got)
+	want := []string{"web-0-1/1.log", "web-0.log", "web-0/3.log", "web-0/3.log.1", "web-0/4.log", "web-0/notes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
+
+func TestPrunePerAttemptLogsWithoutDir(t *testing.T) {
+	if err := prunePerAttemptLogs(filepath.Join(t.TempDir(), "web-0", "1.log"), 2); err != nil {
+		t.Errorf("prunePerAttemptLogs() of a new replica = %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package replica_registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("replica not found or not running")
+var ErrNoStdin = errors.New("replica stdin is not interactive")
+var ErrMultipleLines = errors.New("stdin line cannot contain new lines")
+var ErrStdinTimeout = errors.New("replica is not reading its stdin")
+
+// How long a line waits to be written to the stdin of a replica that doesn't read it.
+const stdinWriteTimeout = 5 * time.Second
+
+// Replica is the running attempt of a process replica, as seen by the control API.
+type Replica struct {
+	Index   int
+	Name    string
+	Pid     int
+	Attempt int
+	stdin   io.WriteCloser
+	// Holds a value while a line is written to stdin, so lines written concurrently don't get interleaved. A channel
+	// rather than a mutex, so waiting for it can time out.
+	stdinLock chan struct{}
+}
+
+// Output is a line written by a replica, or a lifecycle event of it, as streamed to the attached subscribers.
+type Output struct {
+	Stream  string `json:"stream"` // stdout, stderr, started or exited
+	Pid     int    `json:"pid"`
+	Attempt int    `json:"attempt"`
+	Data    string `json:"data,omitempty"`
+	// Continued is true when Data is a chunk of a long line that continues in the next output.
+	Continued bool `json:"continued,omitempty"`
+}
+
+// Amount of output lines buffered per subscriber. When a subscriber falls behind, newer lines are dropped for it
+// rather than blocking the replica.
+const subscriberBufferSize = 256
+
+var (
+	replicas = map[int]*Replica{}
+	// seen holds the indexes of all the replicas that have run at least once.
+	seen        = map[int]bool{}
+	subscribers = map[int][]chan Output{}
+	// Locks reads and writes to replicas, seen and subscribers.
+	lock sync.Mutex
+)
+
+// Register adds the running attempt of a replica, replacing any previous attempt with the same index. stdin is nil if
+// the replica's stdin is not interactive.
+func Register(index int, name string, pid int, attempt int, stdin io.WriteCloser) *Replica {
+	r := &Replica{Index: index, Name: name, Pid: pid, Attempt: attempt, stdin: stdin, stdinLock: make(chan struct{}, 1)}
+	lock.Lock()
+	replicas[index] = r
+	seen[index] = true
+	lock.Unlock()
+	return r
+}
+
+// Unregister removes the replica, only if it's still the given attempt.
+func Unregister(r *Replica) {
+	lock.Lock()
+	if replicas[r.Index] == r {
+		delete(replicas, r.Index)
+	}
+	lock.Unlock()
+}
+
+func Get(index int) *Replica {
+	lock.Lock()
+	defer lock.Unlock()
+	return replicas[index]
+}
+
+// Count returns the amount of replicas currently running.
+func Count() int {
+	lock.Lock()
+	defer lock.Unlock()
+	return len(replicas)
+}
+
+// WriteLine writes a line to the stdin of the replica at the given index. A trailing new line is added if missing.
+// Returns ErrStdinTimeout if the line cannot be written within stdinWriteTimeout, eg: the pipe is full because the
+// replica doesn't read its stdin.
+func WriteLine(index int, line string) error {
+	line = strings.TrimSuffix(line, "\n")
+	if strings.Contains(line, "\n") {
+		return ErrMultipleLines
+	}
+	r := Get(index)
+	if r == nil {
+		return ErrNotFound
+	}
+	if r.stdin == nil {
+		return ErrNoStdin
+	}
+
+	timeout := time.NewTimer(stdinWriteTimeout)
+	defer timeout.Stop()
+	select {
+	case r.stdinLock <- struct{}{}:
+	case <-timeout.C:
+		return ErrStdinTimeout
+	}
+
+	// The write keeps the lock until it ends, even if it outlives the timeout
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(r.stdin, line+"\n")
+		<-r.stdinLock
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("cannot write to stdin of replica %d (PID %d): %w", r.Index, r.Pid, err)
+		}
+		return nil
+	case <-timeout.C:
+		return ErrStdinTimeout
+	}
+}
+
+// Subscribe returns a channel receiving the output of the replica at the given index, across restarts, until cancel is
+// called.
+func Subscribe(index int) (output <-chan Output, cancel func(), err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if !seen[index] {
+		return nil, nil, ErrNotFound
+	}
+
+	c := make(chan Output, subscriberBufferSize)
+	subscribers[index] = append(subscribers[index], c)
+	cancel = func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for i, x := range subscribers[index] {
+			if x == c {
+				subscribers[index] = append(subscribers[index][:i], subscribers[index][i+1:]...)
+				close(c)
+				break
+			}
+		}
+	}
+	return c, cancel, nil
+}
+
+// Publish sends the output to all the subscribers of the replica at the given index without blocking.
+func Publish(index int, output Output) {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, c := range subscribers[index] {
+		select {
+		case c <- output:
+		default:
+		}
+	}
+}
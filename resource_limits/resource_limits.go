@@ -0,0 +1,26 @@
+package resource_limits
+
+// Limits are the resource limits of a single replica. Zero values mean no limit.
+type Limits struct {
+	// MemoryMax in bytes
+	MemoryMax int64
+	// CpuMax in amount of CPUs, eg: 1.5
+	CpuMax  float64
+	PidsMax int64
+	Nofile  uint64
+}
+
+// ShimCommand is the hidden subcommand of the daemon that sets the rlimits of a replica before executing it, see
+// RunShim.
+const ShimCommand = "__rlimit-shim"
+
+// Applied is a handle to the limits of a replica, prepared before it starts.
+type Applied struct {
+	cgroupDir string
+	// rlimits set by the shim, eg: `nofile=1024`
+	rlimits []string
+	// Method describes how the limits are enforced, eg: `cgroup /sys/fs/cgroup/x/replica-0-1` or `rlimits`.
+	Method string
+	// Warnings about the limits that couldn't be enforced.
+	Warnings []string
+}
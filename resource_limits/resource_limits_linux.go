@@ -0,0 +1,331 @@
+package resource_limits
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Controllers enabled for the sub-cgroups of the replicas.
+var wantedControllers = []string{"cpu", "memory", "pids"}
+
+// Sub-cgroup the daemon moves itself to. In cgroup v2, controllers can only be enabled for the children of a cgroup
+// without processes of its own.
+const daemonLeafCgroup = "rex-hive-daemon"
+
+const cpuMaxPeriodMicros = 100000
+
+// RLIMIT_NPROC is not defined by the syscall package.
+const rlimitNproc = 6
+
+var (
+	setupOnce sync.Once
+	// delegatedCgroup is the cgroup the replicas' sub-cgroups are created in, empty if the daemon has not been
+	// delegated a cgroup v2 with the wanted controllers.
+	delegatedCgroup string
+	// cgroupFdSupported tells if processes can be started directly in a cgroup, which needs clone3, ie: linux 5.7.
+	cgroupFdSupported bool
+	setupErr          error
+)
+
+// shimPath re-executes the daemon, its binary is still reachable if it was replaced or deleted since it started.
+const shimPath = "/proc/self/exe"
+
+// Prepare sets up the limits of a replica before it's started: a sub-cgroup with the given name if the daemon has been
+// delegated a cgroup v2, or rlimits otherwise. Open files are always limited with rlimits.
+func Prepare(name string, limits Limits) (*Applied, error) {
+	setupOnce.Do(setup)
+
+	a := &Applied{}
+	if delegatedCgroup != "" {
+		dir := filepath.Join(delegatedCgroup, name)
+		if err := createCgroup(dir, limits); err != nil {
+			a.Warnings = append(a.Warnings, fmt.Sprintf("cannot use cgroup %s, falling back to rlimits: %s", dir, err))
+			_ = os.Remove(dir)
+		} else {
+			a.cgroupDir = dir
+			a.Method = "cgroup " + dir
+		}
+	} else if setupErr != nil {
+		a.Warnings = append(a.Warnings, fmt.Sprintf("cgroup v2 not available, falling back to rlimits: %s", setupErr))
+	}
+
+	if a.cgroupDir == "" {
+		a.Method = "rlimits"
+		if limits.MemoryMax > 0 {
+			a.rlimits = append(a.rlimits, fmt.Sprintf("as=%d", limits.MemoryMax))
+			a.Warnings = append(a.Warnings, "memory is limited as address space, the kernel won't OOM-kill the process but its allocations will fail")
+		}
+		if limits.PidsMax > 0 {
+			a.rlimits = append(a.rlimits, fmt.Sprintf("nproc=%d", limits.PidsMax))
+			a.Warnings = append(a.Warnings, "pids are limited per user, not per replica")
+		}
+		if limits.CpuMax > 0 {
+			a.Warnings = append(a.Warnings, "CPU cannot be limited without cgroups, cpuMax is ignored")
+		}
+	}
+	if limits.Nofile > 0 {
+		a.rlimits = append(a.rlimits, fmt.Sprintf("nofile=%d", limits.Nofile))
+	}
+	return a, nil
+}
+
+// Start starts cmd with start so that neither the process nor anything it forks runs without its limits: it's created
+// directly in the sub-cgroup, and its rlimits are set by the daemon re-executed as a shim that then executes cmd.
+//
+// On linux older than 5.7 the process is moved to the sub-cgroup right after it started, and might fork before that.
+func (a *Applied) Start(cmd *exec.Cmd, start func() error) error {
+	if a == nil {
+		return start()
+	}
+	if len(a.rlimits) > 0 {
+		if err := wrapInShim(cmd, a.rlimits); err != nil {
+			return err
+		}
+	}
+	if a.cgroupDir == "" {
+		return start()
+	}
+	if !cgroupFdSupported {
+		if err := start(); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(a.cgroupDir, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0); err != nil {
+			a.Warnings = append(a.Warnings, fmt.Sprintf("cannot move the process to cgroup %s, it runs without its cgroup limits: %s", a.cgroupDir, err))
+			a.Method = "rlimits"
+		} else {
+			a.Warnings = append(a.Warnings, "the process was moved to its cgroup after it started, it might have forked outside of it")
+		}
+		return nil
+	}
+
+	dir, err := os.Open(a.cgroupDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return start()
+}
+
+// wrapInShim makes cmd run the shim, that sets the rlimits before executing the original command.
+func wrapInShim(cmd *exec.Cmd, rlimits []string) error {
+	// The shim can only report its own failure to execute the command with an exit code, fail early instead
+	path := cmd.Path
+	if cmd.Dir != "" && !filepath.IsAbs(path) && strings.ContainsRune(path, filepath.Separator) {
+		path = filepath.Join(cmd.Dir, path)
+	}
+	if _, err := exec.LookPath(path); err != nil && cmd.Err == nil {
+		return err
+	}
+
+	args := append([]string{"rex-hive-daemon", ShimCommand}, rlimits...)
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = shimPath
+	return nil
+}
+
+// RunShim is the entrypoint of the shim, called with `name=limit...  -- path argv...`. It sets the rlimits and
+// executes path, only returning if it fails. Without a path it returns right after setting the rlimits.
+func RunShim(args []string) int {
+	resources := map[string]int{"as": syscall.RLIMIT_AS, "nproc": rlimitNproc, "nofile": syscall.RLIMIT_NOFILE}
+	for len(args) > 0 && args[0] != "--" {
+		name, value, _ := strings.Cut(args[0], "=")
+		args = args[1:]
+		resource, ok := resources[name]
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if !ok || err != nil {
+			fmt.Fprintf(os.Stderr, "rex-hive-daemon: invalid rlimit %s=%s\n", name, value)
+			return 127
+		}
+		// syscall.Setrlimit keeps the limit of open files for the executed command instead of restoring the default
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			fmt.Fprintf(os.Stderr, "rex-hive-daemon: cannot set rlimit %s=%d: %s\n", name, limit, err)
+			return 127
+		}
+	}
+	if len(args) < 3 {
+		return 0
+	}
+	path, argv := args[1], args[2:]
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "rex-hive-daemon: cannot execute %s: %s\n", path, err)
+	return 127
+}
+
+// OomKilled tells if the kernel killed a process of the cgroup for exceeding its memory limit.
+func (a *Applied) OomKilled() bool {
+	if a == nil || a.cgroupDir == "" {
+		return false
+	}
+	f, err := os.Open(filepath.Join(a.cgroupDir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n > 0
+		}
+	}
+	return false
+}
+
+// Release removes the sub-cgroup, killing any descendant of the process left in it.
+func (a *Applied) Release() {
+	if a == nil || a.cgroupDir == "" {
+		return
+	}
+	// cgroup.kill exists since linux 5.14
+	_ = os.WriteFile(filepath.Join(a.cgroupDir, "cgroup.kill"), []byte("1"), 0)
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(a.cgroupDir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// setup finds the cgroup v2 of the daemon and, if it's delegated to it, moves the daemon into a leaf sub-cgroup and
+// enables the wanted controllers for the sub-cgroups of the replicas.
+func setup() {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		setupErr = err
+		return
+	}
+	rel, err := ownCgroup()
+	if err != nil {
+		setupErr = err
+		return
+	}
+	dir := filepath.Join(mount, rel)
+
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		setupErr = err
+		return
+	}
+	var enable []string
+	for _, c := range wantedControllers {
+		for _, a := range strings.Fields(string(available)) {
+			if a == c {
+				enable = append(enable, "+"+c)
+			}
+		}
+	}
+	if len(enable) <= 0 {
+		setupErr = fmt.Errorf("none of the controllers %v are available in %s", wantedControllers, dir)
+		return
+	}
+
+	// The daemon might already be in its leaf cgroup, eg: after a restart of the daemon in the same cgroup
+	if filepath.Base(dir) == daemonLeafCgroup {
+		dir = filepath.Dir(dir)
+	} else {
+		leaf := filepath.Join(dir, daemonLeafCgroup)
+		if err := os.Mkdir(leaf, 0o755); err != nil && !os.IsExist(err) {
+			setupErr = fmt.Errorf("cgroup %s is not delegated to the daemon: %w", dir, err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+			setupErr = fmt.Errorf("cannot move the daemon to %s: %w", leaf, err)
+			return
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0); err != nil {
+		setupErr = fmt.Errorf("cannot enable controllers in %s: %w", dir, err)
+		return
+	}
+	delegatedCgroup = dir
+	cgroupFdSupported = startsInCgroup(filepath.Join(dir, daemonLeafCgroup))
+}
+
+// startsInCgroup tells if a process can be started directly in a cgroup, by starting the shim without a command.
+// clone3 might also be blocked by a seccomp filter, eg: in a container.
+func startsInCgroup(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	cmd := exec.Command(shimPath, ShimCommand)
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())}
+	return cmd.Run() == nil
+}
+
+func createCgroup(dir string, limits Limits) error {
+	if err := os.Mkdir(dir, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if limits.MemoryMax > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(limits.MemoryMax, 10)), 0); err != nil {
+			return err
+		}
+	}
+	if limits.CpuMax > 0 {
+		quota := int64(limits.CpuMax * cpuMaxPeriodMicros)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cpuMaxPeriodMicros)), 0); err != nil {
+			return err
+		}
+	}
+	if limits.PidsMax > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "pids.max"), []byte(strconv.FormatInt(limits.PidsMax, 10)), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted, eg: `/sys/fs/cgroup`.
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: `id parent major:minor root mount-point options [optional fields] - fstype source super-options`
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no cgroup2 mount found")
+}
+
+// ownCgroup returns the cgroup v2 of the daemon, relative to the cgroup v2 mount.
+func ownCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// The cgroup v2 entry has hierarchy ID 0 and no controllers, eg: `0::/system.slice/rex.service`
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("the daemon is not in a cgroup v2")
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package resource_limits
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func Prepare(name string, limits Limits) (*Applied, error) {
+	return nil, errors.New("resource limits are only supported on linux")
+}
+
+func (a *Applied) Start(cmd *exec.Cmd, start func() error) error {
+	return start()
+}
+
+func RunShim(args []string) int {
+	fmt.Fprintln(os.Stderr, "rex-hive-daemon: resource limits are only supported on linux")
+	return 127
+}
+
+func (a *Applied) OomKilled() bool {
+	return false
+}
+
+func (a *Applied) Release() {}
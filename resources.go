@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"rex-hive-daemon/hive_message"
+	"rex-hive-daemon/hive_spec"
+	"rex-hive-daemon/proc_metrics"
+	"rex-hive-daemon/resource_limits"
+	"strings"
+	"time"
+)
+import p "rex-hive-daemon/rexprint"
+
+// prepareResources sets up the resource limits of the spec for a replica about to start. The replica still starts when
+// the limits cannot be set up. Returns nil if the spec has no limits.
+func prepareResources(source p.Source, processSpec *hive_spec.ProcessSpec, index int, attempt int) *resource_limits.Applied {
+	r := processSpec.Resources
+	if r == nil {
+		return nil
+	}
+	limits := resource_limits.Limits{
+		MemoryMax: r.MemoryMaxBytes,
+		CpuMax:    r.CpuMaxCpus,
+		PidsMax:   r.PidsMax,
+		Nofile:    r.Nofile,
+	}
+	applied, err := resource_limits.Prepare(fmt.Sprintf("replica-%d-%d", index, attempt), limits)
+	if err != nil {
+		p.PrintLnColor(source, p.ErrColor(fmt.Sprintf("cannot limit resources: %s", err.Error())))
+	}
+	return applied
+}
+
+// reportResources prints how the limits are enforced on the started replica.
+func (a *runAttempt) reportResources(applied *resource_limits.Applied) {
+	if applied == nil {
+		return
+	}
+	for _, w := range applied.Warnings {
+		p.PrintLnColor(a.source, p.ErrColor("resources:"), w)
+	}
+	p.PrintLnColor(a.source, p.Dim(fmt.Sprintf("limited resources to %s with %s", describeResources(a.processSpec.Resources), applied.Method)))
+}
+
+// releaseResources reports an OOM kill of the replica and releases its limits once it exited.
+func (a *runAttempt) releaseResources(applied *resource_limits.Applied) {
+	if applied == nil {
+		return
+	}
+	defer applied.Release()
+	if !applied.OomKilled() {
+		return
+	}
+	msg := fmt.Sprintf("killed for exceeding memoryMax %s", a.processSpec.Resources.MemoryMax)
+	p.PrintLnColor(a.source, p.ErrColor(msg))
+	writeReplicaLog(a.logFile, string(hive_message.ProcessOomKilled), a.pid, a.attempt, msg)
+	*a.hiveChan <- &hive_message.HiveMessage{
+		Index:    a.index,
+		Pid:      a.pid,
+		Attempt:  a.attempt,
+		Type:     hive_message.ProcessOomKilled,
+		Data:     msg,
+		ExitCode: noExitCode,
+	}
+}
+
+// sampleMetrics sends a sample of the resource usage of the replica every interval of the spec, until done is closed.
+func (a *runAttempt) sampleMetrics(done chan bool) {
+	m := a.processSpec.Metrics
+	if m == nil {
+		return
+	}
+	sampler := proc_metrics.NewSampler(a.pid)
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		metrics, err := sampler.Sample()
+		if err != nil {
+			// The process might have just exited
+			select {
+			case <-done:
+			default:
+				p.PrintLnColor(a.source, p.ErrColor("cannot sample metrics:"), err.Error())
+			}
+			return
+		}
+		message := &hive_message.HiveMessage{
+			Index:    a.index,
+			Pid:      a.pid,
+			Attempt:  a.attempt,
+			Type:     hive_message.ProcessMetrics,
+			ExitCode: noExitCode,
+			Metrics:  metrics,
+		}
+		select {
+		case *a.hiveChan <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// describeResources returns the limits set in the spec, eg: `memoryMax 512M, cpuMax 1.5`.
+func describeResources(r *hive_spec.ResourcesSpec) string {
+	var limits []string
+	if r.MemoryMax != "" {
+		limits = append(limits, "memoryMax "+r.MemoryMax)
+	}
+	if r.CpuMax != "" {
+		limits = append(limits, "cpuMax "+r.CpuMax)
+	}
+	if r.PidsMax > 0 {
+		limits = append(limits, fmt.Sprintf("pidsMax %d", r.PidsMax))
+	}
+	if r.Nofile > 0 {
+		limits = append(limits, fmt.Sprintf("nofile %d", r.Nofile))
+	}
+	return strings.Join(limits, ", ")
+}
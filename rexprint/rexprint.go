@@ -1,56 +1,178 @@
 package rexprint
 
 import (
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func printAllColors() {
-	colors := GetRandomColors()
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
 
-	for i, c := range colors {
-		fmt.Println(fmt.Sprintf("\x1b[%dm%s\x1b[0m", c, fmt.Sprintf("[%d]:%d", i, c)))
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// StreamDaemon is the stream of the lines printed by the daemon itself, as opposed to the output of a process.
+const StreamDaemon = "daemon"
+
+var (
+	format   = FormatText
+	useColor = true
+	// Locks printing, so JSON lines printed from different goroutines are never interleaved.
+	printLock sync.Mutex
+)
+
+// Source identifies the replica a printed line is about.
+type Source struct {
+	Name    string
+	Index   int
+	Pid     int
+	Attempt int
+}
+
+// Configure sets the format of the printed lines, `text` or `json`, and whether text lines are colored: `always`,
+// `never` or `auto` to color them only when stdout is a terminal. JSON lines are never colored.
+func Configure(logFormat string, color string) error {
+	switch logFormat {
+	case FormatText, FormatJson:
+	default:
+		return fmt.Errorf("invalid log format '%s', expected '%s' or '%s'", logFormat, FormatText, FormatJson)
 	}
+
+	switch color {
+	case ColorAlways:
+		useColor = true
+	case ColorNever:
+		useColor = false
+	case ColorAuto:
+		// See https://no-color.org
+		useColor = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	default:
+		return fmt.Errorf("invalid color '%s', expected '%s', '%s' or '%s'", color, ColorAuto, ColorAlways, ColorNever)
+	}
+
+	format = logFormat
+	if format == FormatJson {
+		useColor = false
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Colors used for the prefix of the replicas. Some colors are left out since they're barely visible or too similar to
+// others: 37, 90 and 91 (very similar to red, 31).
+var colors = []int{31, 32, 33, 34, 35, 36, 92, 93, 94, 95, 96, 97}
+
+// DefaultPrefix is the default template of the prefix of text lines about a replica.
+const DefaultPrefix = "[{index}:{pid}:{attempt}]"
+
+var prefix = DefaultPrefix
+
+// SetPrefix sets the template of the prefix of text lines about a replica. The placeholders {time} (with
+// milliseconds), {name}, {index}, {pid}, {attempt} and {stream} are replaced by the values of each line.
+func SetPrefix(template string) {
+	prefix = template
 }
 
-func GetRandomColors() []int {
-	colors := []int{
-		31,
-		32,
-		33,
-		34,
-		35,
-		36,
-		//37, Barely visible
-		//90, Barely visible
-		//91, Very similar to red (31)
-		92,
-		93,
-		94,
-		95,
-		96,
-		97,
+// colorOf returns a color that only depends on the name, so all the replicas of a process always share the same color.
+func colorOf(name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
+
+func printAllColors() {
+	for i, c := range colors {
+		fmt.Println(getColored(c, fmt.Sprintf("[%d]:%d", i, c)))
 	}
+}
 
-	// Shuffle colors array
-	//rand.Seed(time.Now().UnixNano())
-	// Prefer a constant color distribution for easier debugging
-	rand.Seed(3)
-	for i := range colors {
-		j := rand.Intn(i + 1)
-		colors[i], colors[j] = colors[j], colors[i]
+// jsonLine is a line printed with the `json` format.
+type jsonLine struct {
+	Time    string `json:"time"`
+	Name    string `json:"name,omitempty"`
+	Index   *int   `json:"index,omitempty"`
+	Pid     *int   `json:"pid,omitempty"`
+	Attempt *int   `json:"attempt,omitempty"`
+	Stream  string `json:"stream"`
+	Message string `json:"message"`
+}
+
+// PrintLnColor prints a line of the daemon about the replica, prefixed by the replica's prefix in the process' color.
+func PrintLnColor(source Source, msg ...any) {
+	printLine(&source, StreamDaemon, "", msg...)
+}
+
+// PrintStream prints a line of the output of the replica, from the given stream, eg: `stdout`.
+func PrintStream(source Source, stream string, msg ...any) {
+	label := OutColor(strings.ToUpper(stream))
+	if stream == "stderr" {
+		label = ErrColor(strings.ToUpper(stream))
 	}
-	return colors
+	printLine(&source, stream, label, msg...)
+}
+
+// Println prints a line of the daemon not related to any replica.
+func Println(msg ...any) {
+	printLine(nil, StreamDaemon, "", msg...)
 }
 
-func PrintLnColor(id string, colors []int, i int, msg ...any) {
-	colorIndex := i % len(colors)
-	colored := fmt.Sprintf("\x1b[%dm%s\x1b[0m", colors[colorIndex], fmt.Sprintf("[%s]", id))
-	msg = append([]any{colored}, msg...)
+func printLine(source *Source, stream string, label string, msg ...any) {
+	printLock.Lock()
+	defer printLock.Unlock()
+
+	now := time.Now()
+	if format == FormatJson {
+		l := jsonLine{
+			Time:    now.UTC().Format(time.RFC3339Nano),
+			Stream:  stream,
+			Message: strings.TrimSuffix(fmt.Sprintln(msg...), "\n"),
+		}
+		if source != nil {
+			l.Name = source.Name
+			l.Index, l.Pid, l.Attempt = &source.Index, &source.Pid, &source.Attempt
+		}
+		b, _ := json.Marshal(l)
+		fmt.Println(string(b))
+		return
+	}
+
+	// The label is redundant when the prefix already has the stream
+	if label != "" && !strings.Contains(prefix, "{stream}") {
+		msg = append([]any{label}, msg...)
+	}
+	if source != nil {
+		p := strings.NewReplacer(
+			"{time}", now.Format("15:04:05.000"),
+			"{name}", source.Name,
+			"{index}", strconv.Itoa(source.Index),
+			"{pid}", strconv.Itoa(source.Pid),
+			"{attempt}", strconv.Itoa(source.Attempt),
+			"{stream}", stream,
+		).Replace(prefix)
+		msg = append([]any{getColored(colorOf(source.Name), p)}, msg...)
+	}
 	fmt.Println(msg...)
 }
 
 func getColored(color int, text string) string {
+	if !useColor {
+		return text
+	}
 	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, text)
 }
 
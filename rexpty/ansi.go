@@ -0,0 +1,11 @@
+package rexpty
+
+import "regexp"
+
+// Matches CSI sequences (colors, cursor movement), OSC sequences (window titles) and two-char escape sequences.
+var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// StripAnsi removes the ANSI escape sequences from text.
+func StripAnsi(text string) string {
+	return ansiRegex.ReplaceAllString(text, "")
+}
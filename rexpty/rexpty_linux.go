@@ -0,0 +1,68 @@
+package rexpty
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Open allocates a new pseudo-terminal with the given window size. The slave end is meant to be the stdin, stdout and
+// stderr of the child process, the master end is read by the daemon to capture its output.
+func Open(columns int, rows int) (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Close the master on any error after this point
+	defer func() {
+		if err != nil {
+			_ = master.Close()
+		}
+	}()
+
+	var n uint32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return nil, nil, fmt.Errorf("cannot get pty number: %w", err)
+	}
+	var unlock int32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return nil, nil, fmt.Errorf("cannot unlock pty: %w", err)
+	}
+	if err = SetSize(master, columns, rows); err != nil {
+		return nil, nil, err
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// SetSize sets the window size of the pseudo-terminal.
+func SetSize(master *os.File, columns int, rows int) error {
+	ws := struct {
+		Row    uint16
+		Col    uint16
+		Xpixel uint16
+		Ypixel uint16
+	}{Row: uint16(rows), Col: uint16(columns)}
+	if err := ioctl(master.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return fmt.Errorf("cannot set pty window size: %w", err)
+	}
+	return nil
+}
+
+// SysProcAttr makes the child process a session leader with the pty slave (its stdin, fd 0) as controlling terminal.
+func SysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
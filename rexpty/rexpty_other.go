@@ -0,0 +1,23 @@
+//go:build !linux
+
+package rexpty
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errUnsupported = errors.New("pseudo-terminals are only supported on linux")
+
+func Open(columns int, rows int) (master *os.File, slave *os.File, err error) {
+	return nil, nil, errUnsupported
+}
+
+func SetSize(master *os.File, columns int, rows int) error {
+	return errUnsupported
+}
+
+func SysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}